@@ -0,0 +1,53 @@
+package httplib
+
+import "net/http"
+
+// Middleware wraps a handler with additional behaviour.
+type Middleware func(next http.Handler) http.Handler
+
+// Chain is an immutable list of middlewares applied in declared order: the
+// first middleware is the outermost one and sees the request first.
+// A chain can be extended and shared between several muxes and sub-routers.
+type Chain struct {
+	middlewares []Middleware
+}
+
+// NewChain creates a new Chain of middlewares.
+func NewChain(middlewares ...Middleware) Chain {
+	return Chain{middlewares: append([]Middleware(nil), middlewares...)}
+}
+
+// Append returns a new chain with middlewares added after the ones of c.
+// The chain c is left unchanged.
+func (c Chain) Append(middlewares ...Middleware) Chain {
+	merged := make([]Middleware, 0, len(c.middlewares)+len(middlewares))
+	merged = append(merged, c.middlewares...)
+	merged = append(merged, middlewares...)
+	return Chain{middlewares: merged}
+}
+
+// Extend returns a new chain with the middlewares of other added after the ones of c.
+func (c Chain) Extend(other Chain) Chain {
+	return c.Append(other.middlewares...)
+}
+
+// Then wraps h with the middlewares of the chain. A nil handler is replaced
+// by http.DefaultServeMux.
+func (c Chain) Then(h http.Handler) http.Handler {
+	if h == nil {
+		h = http.DefaultServeMux
+	}
+
+	for i := len(c.middlewares) - 1; i >= 0; i-- {
+		h = c.middlewares[i](h)
+	}
+	return h
+}
+
+// ThenFunc wraps fn with the middlewares of the chain.
+func (c Chain) ThenFunc(fn http.HandlerFunc) http.Handler {
+	if fn == nil {
+		return c.Then(nil)
+	}
+	return c.Then(fn)
+}
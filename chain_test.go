@@ -0,0 +1,76 @@
+package httplib_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lab42/httplib"
+)
+
+// tagMiddleware appends tag to the X-Trace header before calling the next handler.
+func tagMiddleware(tag string) httplib.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("X-Trace", tag)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestChainOrder(t *testing.T) {
+	chain := httplib.NewChain(tagMiddleware("a"), tagMiddleware("b"))
+	handler := chain.ThenFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("X-Trace", "handler")
+	})
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+	// Middlewares run in declared order.
+	expected := []string{"a", "b", "handler"}
+	if got := rr.Header().Values("X-Trace"); !stringSlicesEqual(got, expected) {
+		t.Errorf("Expected trace %v, but got %v", expected, got)
+	}
+}
+
+func TestChainAppendIsImmutable(t *testing.T) {
+	base := httplib.NewChain(tagMiddleware("a"))
+	api := base.Append(tagMiddleware("api"))
+	admin := base.Append(tagMiddleware("admin")).Extend(httplib.NewChain(tagMiddleware("audit")))
+
+	tests := []struct {
+		chain    httplib.Chain
+		expected []string
+	}{
+		{base, []string{"a"}},
+		{api, []string{"a", "api"}},
+		{admin, []string{"a", "admin", "audit"}},
+	}
+
+	// The same chains can be shared between several muxes.
+	for _, tt := range tests {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+
+		rr := httptest.NewRecorder()
+		tt.chain.Then(mux).ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+		if got := rr.Header().Values("X-Trace"); !stringSlicesEqual(got, tt.expected) {
+			t.Errorf("Expected trace %v, but got %v", tt.expected, got)
+		}
+	}
+}
+
+// Helper function to check if two string slices are equal.
+func stringSlicesEqual(slice1, slice2 []string) bool {
+	if len(slice1) != len(slice2) {
+		return false
+	}
+	for i := range slice1 {
+		if slice1[i] != slice2[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -2,6 +2,7 @@ package internal
 
 import (
 	"net/http"
+	"path"
 	"strings"
 )
 
@@ -18,12 +19,19 @@ func ObfuscateSensitiveData(key string, values []string, sensitiveKeys []string)
 }
 
 // isSensitiveField checks if a field (identified by key) contains sensitive data based on sensitive keys.
+// Sensitive keys are compared case-insensitively and may be globs using the syntax of path.Match,
+// such as "*token*".
 func IsSensitiveField(key string, sensitiveKeys []string) bool {
 	// Check if the key matches any of the sensitive keys
 	for _, sensitiveKey := range sensitiveKeys {
 		if strings.EqualFold(key, sensitiveKey) {
 			return true
 		}
+		if strings.ContainsAny(sensitiveKey, "*?[") {
+			if ok, _ := path.Match(strings.ToLower(sensitiveKey), strings.ToLower(key)); ok {
+				return true
+			}
+		}
 	}
 	return false
 }
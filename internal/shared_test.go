@@ -47,6 +47,24 @@ func TestIsSensitiveField(t *testing.T) {
 	}
 }
 
+func TestIsSensitiveFieldGlob(t *testing.T) {
+	sensitiveKeys := []string{"*token*", "x-api-?ey"}
+
+	// Test case 1: Keys matching a glob, whatever their case.
+	for _, key := range []string{"access_token", "TokenID", "X-API-Key"} {
+		if !internal.IsSensitiveField(key, sensitiveKeys) {
+			t.Errorf("Expected IsSensitiveField to return true for key '%s', but got false", key)
+		}
+	}
+
+	// Test case 2: Keys not matching any glob.
+	for _, key := range []string{"username", "x-api-version"} {
+		if internal.IsSensitiveField(key, sensitiveKeys) {
+			t.Errorf("Expected IsSensitiveField to return false for key '%s', but got true", key)
+		}
+	}
+}
+
 // Helper function to check if two string slices are equal.
 func stringSlicesEqual(slice1, slice2 []string) bool {
 	if len(slice1) != len(slice2) {
@@ -0,0 +1,141 @@
+package httplib
+
+import (
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Matcher reports whether a request matches a condition.
+type Matcher func(r *http.Request) bool
+
+// PathPrefix matches requests whose path starts with one of the prefixes.
+func PathPrefix(prefixes ...string) Matcher {
+	return func(r *http.Request) bool {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// PathGlob matches requests whose path matches one of the patterns, using the
+// syntax of path.Match. A "*" does not match across "/".
+func PathGlob(patterns ...string) Matcher {
+	return func(r *http.Request) bool {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, r.URL.Path); ok {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// PathRegexp matches requests whose path matches the regular expression.
+// It panics if the expression cannot be parsed.
+func PathRegexp(expr string) Matcher {
+	re := regexp.MustCompile(expr)
+	return func(r *http.Request) bool {
+		return re.MatchString(r.URL.Path)
+	}
+}
+
+// Method matches requests using one of the methods.
+func Method(methods ...string) Matcher {
+	return func(r *http.Request) bool {
+		for _, method := range methods {
+			if strings.EqualFold(r.Method, method) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Header matches requests with a header equal to value, or with the header
+// present if value is empty.
+func Header(name, value string) Matcher {
+	return func(r *http.Request) bool {
+		values := r.Header.Values(name)
+		if value == "" {
+			return len(values) > 0
+		}
+		for _, v := range values {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Host matches requests sent to one of the hosts, ignoring the port.
+func Host(hosts ...string) Matcher {
+	return func(r *http.Request) bool {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		for _, h := range hosts {
+			if strings.EqualFold(host, h) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Any matches requests matching at least one of the matchers.
+func Any(matchers ...Matcher) Matcher {
+	return func(r *http.Request) bool {
+		for _, m := range matchers {
+			if m(r) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// All matches requests matching all of the matchers.
+func All(matchers ...Matcher) Matcher {
+	return func(r *http.Request) bool {
+		for _, m := range matchers {
+			if !m(r) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Not matches requests not matching m.
+func Not(m Matcher) Matcher {
+	return func(r *http.Request) bool {
+		return !m(r)
+	}
+}
+
+// When returns a middleware that applies mw only to requests matching m.
+func When(m Matcher, mw Middleware) Middleware {
+	return func(next http.Handler) http.Handler {
+		wrapped := mw(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if m(r) {
+				wrapped.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Unless returns a middleware that applies mw to all requests except the ones matching m.
+func Unless(m Matcher, mw Middleware) Middleware {
+	return When(Not(m), mw)
+}
@@ -0,0 +1,70 @@
+package httplib_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lab42/httplib"
+)
+
+func TestMatchers(t *testing.T) {
+	req := httptest.NewRequest("POST", "http://api.example.com:8080/webhooks/github/42", nil)
+	req.Header.Set("X-Hub-Signature", "sha1=abc")
+
+	tests := []struct {
+		name     string
+		matcher  httplib.Matcher
+		expected bool
+	}{
+		{"PathPrefix", httplib.PathPrefix("/webhooks/"), true},
+		{"PathPrefix mismatch", httplib.PathPrefix("/metrics"), false},
+		{"PathGlob", httplib.PathGlob("/webhooks/*/*"), true},
+		{"PathGlob does not cross slashes", httplib.PathGlob("/webhooks/*"), false},
+		{"PathRegexp", httplib.PathRegexp(`^/webhooks/\w+/\d+$`), true},
+		{"Method", httplib.Method("GET", "post"), true},
+		{"Method mismatch", httplib.Method("GET"), false},
+		{"Header present", httplib.Header("X-Hub-Signature", ""), true},
+		{"Header value", httplib.Header("X-Hub-Signature", "sha1=abc"), true},
+		{"Header value mismatch", httplib.Header("X-Hub-Signature", "sha1=def"), false},
+		{"Host", httplib.Host("API.example.com"), true},
+		{"Host mismatch", httplib.Host("example.com"), false},
+		{"Any", httplib.Any(httplib.Method("GET"), httplib.PathPrefix("/webhooks")), true},
+		{"All", httplib.All(httplib.Method("POST"), httplib.PathPrefix("/metrics")), false},
+		{"Not", httplib.Not(httplib.PathPrefix("/metrics")), true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.matcher(req); got != tt.expected {
+			t.Errorf("%s: expected %v, but got %v", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestWhenUnless(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+
+	handler := httplib.NewChain(
+		httplib.When(httplib.Method("POST"), tagMiddleware("when")),
+		httplib.Unless(httplib.PathPrefix("/healthz"), tagMiddleware("unless")),
+	).Then(mux)
+
+	tests := []struct {
+		method, path string
+		expected     []string
+	}{
+		{"GET", "/", []string{"unless"}},
+		{"POST", "/", []string{"when", "unless"}},
+		{"GET", "/healthz", nil},
+	}
+
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(tt.method, tt.path, nil))
+
+		if got := rr.Header().Values("X-Trace"); !stringSlicesEqual(got, tt.expected) {
+			t.Errorf("%s %s: expected trace %v, but got %v", tt.method, tt.path, tt.expected, got)
+		}
+	}
+}
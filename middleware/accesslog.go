@@ -0,0 +1,234 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/lab42/httplib"
+)
+
+// accessLogMessage is the message of access-log entries.
+const accessLogMessage = "HTTP request"
+
+// AccessLogConfig holds the settings shared by the access-log middlewares:
+// the ZapMiddleware, the ZeroLogMiddleware and the SlogMiddleware. It runs
+// the next handler and computes the access-log entry once, so that every
+// logger adapter logs identical fields with identical redaction.
+type AccessLogConfig struct {
+	Route           RouteResolver     // Resolves the logged route. Defaults to DefaultRouteResolver.
+	TraceID         TraceIDExtractor  // Extracts the logged trace ID. Defaults to TraceParentID.
+	RequestIDHeader string            // Header holding the request ID. Defaults to X-Request-ID.
+	LogParams       bool              // Logs the query and form parameters, obfuscating sensitive keys.
+	LogHeaders      bool              // Logs the request headers and cookies, obfuscating sensitive keys.
+	Redactor        *httplib.Redactor // Redacts the logged parameters, headers, cookies and bodies. Defaults to redacting the sensitive keys of the middleware.
+	BodyCapture     *BodyCapture      // Captures and logs the request and response bodies when set.
+}
+
+// AccessLogOption configures the AccessLogConfig of an access-log middleware,
+// through WithZapAccessLog, WithZeroLogAccessLog or WithSlogAccessLog.
+type AccessLogOption func(*AccessLogConfig)
+
+// WithAccessLogRoute sets the resolver of the logged route.
+func WithAccessLogRoute(route RouteResolver) AccessLogOption {
+	return func(c *AccessLogConfig) {
+		c.Route = route
+	}
+}
+
+// WithAccessLogTraceID sets the extractor of the logged trace ID, such as
+// the one given to WithPrometheusTraceID.
+func WithAccessLogTraceID(extract TraceIDExtractor) AccessLogOption {
+	return func(c *AccessLogConfig) {
+		c.TraceID = extract
+	}
+}
+
+// WithAccessLogRequestIDHeader sets the header holding the request ID.
+func WithAccessLogRequestIDHeader(header string) AccessLogOption {
+	return func(c *AccessLogConfig) {
+		c.RequestIDHeader = header
+	}
+}
+
+// WithAccessLogParams logs the query and form parameters, obfuscating sensitive keys.
+func WithAccessLogParams() AccessLogOption {
+	return func(c *AccessLogConfig) {
+		c.LogParams = true
+	}
+}
+
+// WithAccessLogHeaders logs the request headers and cookies, obfuscating sensitive keys.
+func WithAccessLogHeaders() AccessLogOption {
+	return func(c *AccessLogConfig) {
+		c.LogHeaders = true
+	}
+}
+
+// WithAccessLogRedactor sets the redactor of the logged parameters, headers,
+// cookies and bodies, in place of the sensitive keys of the middleware.
+func WithAccessLogRedactor(redactor *httplib.Redactor) AccessLogOption {
+	return func(c *AccessLogConfig) {
+		c.Redactor = redactor
+	}
+}
+
+// WithAccessLogBodyCapture logs up to maxBytes of the request and response
+// bodies of the given content types, DefaultBodyCaptureContentTypes when none
+// is given, redacted like the parameters.
+func WithAccessLogBodyCapture(maxBytes int, contentTypes ...string) AccessLogOption {
+	return func(c *AccessLogConfig) {
+		c.BodyCapture = &BodyCapture{MaxBytes: maxBytes, ContentTypes: contentTypes}
+	}
+}
+
+// accessLogLevel is the severity of an access-log entry.
+type accessLogLevel int
+
+const (
+	accessLogInfo  accessLogLevel = iota // Successful and redirected requests.
+	accessLogWarn                        // Requests answered with a 4xx status.
+	accessLogError                       // Requests answered with a 5xx status.
+)
+
+// accessLogField is a field of an access-log entry. Values are strings, ints,
+// int64s, bools, maps of strings or decoded JSON values.
+type accessLogField struct {
+	Key   string
+	Value interface{}
+}
+
+// accessLogEntry is an access-log entry describing a served request.
+type accessLogEntry struct {
+	Level  accessLogLevel
+	Fields []accessLogField
+}
+
+// serve calls next and returns the access-log entry describing the request,
+// redacted with the Redactor or, by default, with the sensitiveKeys of the
+// middleware.
+func (a AccessLogConfig) serve(next http.Handler, w http.ResponseWriter, r *http.Request, sensitiveKeys []string) accessLogEntry {
+	// Record the start time to calculate the request duration
+	now := time.Now()
+	redactor := a.redactor(sensitiveKeys)
+
+	// Tee the bodies while the handler reads and writes them
+	var requestBody *bodyBuffer
+	var responseBody *responseCapture
+	rw := httplib.NewResponseWriter(w)
+	if a.BodyCapture != nil {
+		requestBody = a.BodyCapture.captureRequestBody(r)
+		responseBody = a.BodyCapture.captureResponseBody(w.Header())
+		rw = httplib.NewTeeResponseWriter(w, responseBody)
+	}
+
+	// Call the next handler in the chain
+	next.ServeHTTP(rw, r)
+
+	duration := time.Since(now)
+	status := rw.Status()
+
+	entry := accessLogEntry{
+		Level: accessLogInfo,
+		Fields: []accessLogField{
+			{"method", r.Method},
+			{"route", a.route(r)},
+			{"path", r.URL.Path},
+			{"status", status},
+			{"bytes", rw.BytesWritten()},
+			{"duration_ms", duration.Milliseconds()},
+			{"remote_ip", clientIP(r)},
+			{"user_agent", r.UserAgent()},
+			{"request_id", a.requestID(r)},
+			{"trace_id", a.traceID(r)},
+		},
+	}
+	if a.LogParams {
+		entry.Fields = append(entry.Fields, accessLogField{"params", requestParams(r, redactor)})
+	}
+	if a.LogHeaders {
+		entry.Fields = append(entry.Fields,
+			accessLogField{"headers", redactor.Header(r.Header)},
+			accessLogField{"cookies", redactor.Cookies(r.Cookies())},
+		)
+	}
+	if a.BodyCapture != nil {
+		entry.Fields = append(entry.Fields, bodyFields("request_body", requestBody, r.Header.Get("Content-Type"), redactor)...)
+		entry.Fields = append(entry.Fields, bodyFields("response_body", responseBody.buf, rw.Header().Get("Content-Type"), redactor)...)
+	}
+
+	// The level depends on the response status
+	switch {
+	case status >= http.StatusInternalServerError:
+		entry.Level = accessLogError
+	case status >= http.StatusBadRequest:
+		entry.Level = accessLogWarn
+	}
+
+	return entry
+}
+
+// contextFields returns the request metadata the request-scoped logger is
+// enriched with, so that handler logs correlate with the access log. The
+// route is left out: routers nested in the handler have not matched it yet
+// when the request-scoped logger is made, so the logger adapters resolve it
+// with lazyRoute when handlers log.
+func (a AccessLogConfig) contextFields(r *http.Request) []accessLogField {
+	return []accessLogField{
+		{"request_id", a.requestID(r)},
+		{"method", r.Method},
+		{"trace_id", a.traceID(r)},
+	}
+}
+
+// route resolves the route of r.
+func (a AccessLogConfig) route(r *http.Request) string {
+	if a.Route == nil {
+		return DefaultRouteResolver(r)
+	}
+	return a.Route(r)
+}
+
+// lazyRoute returns a function resolving the route of *r when called. Routers
+// nested in the handler record the matched route on the served request, so
+// *r must be the served request by the time handlers log.
+func (a AccessLogConfig) lazyRoute(r **http.Request) func() string {
+	return func() string {
+		return a.route(*r)
+	}
+}
+
+// traceID returns the trace ID of r.
+func (a AccessLogConfig) traceID(r *http.Request) string {
+	if a.TraceID == nil {
+		return TraceParentID(r)
+	}
+	return a.TraceID(r)
+}
+
+// requestID returns the request ID of r.
+func (a AccessLogConfig) requestID(r *http.Request) string {
+	if a.RequestIDHeader == "" {
+		return r.Header.Get("X-Request-ID")
+	}
+	return r.Header.Get(a.RequestIDHeader)
+}
+
+// redactor returns the redactor of the logged request data, redacting
+// sensitiveKeys when none is configured.
+func (a AccessLogConfig) redactor(sensitiveKeys []string) *httplib.Redactor {
+	if a.Redactor == nil {
+		return httplib.NewRedactor(sensitiveKeys...)
+	}
+	return a.Redactor
+}
+
+// requestParams returns the query parameters of r, and its form parameters
+// when the handler parsed the form, with sensitive values obfuscated. The
+// body is never read, so that it stays available to the handler.
+func requestParams(r *http.Request, redactor *httplib.Redactor) map[string]string {
+	values := r.Form
+	if values == nil {
+		values = r.URL.Query()
+	}
+	return redactor.Values(values)
+}
@@ -0,0 +1,347 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lab42/httplib"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// AdaptiveLimit computes a concurrency limit from the latency of handled requests.
+type AdaptiveLimit interface {
+	// Limit returns the current concurrency limit.
+	Limit() int
+	// Observe records the latency of a request handled while inFlight requests
+	// were in flight, and whether it was dropped (canceled or timed out).
+	Observe(latency time.Duration, inFlight int, dropped bool)
+}
+
+// AIMDLimit is an AdaptiveLimit that increases the limit by one while latency
+// stays below Threshold, and multiplies it by BackoffRatio when it exceeds it.
+type AIMDLimit struct {
+	MinLimit     int           // Lower bound of the limit.
+	MaxLimit     int           // Upper bound of the limit.
+	Threshold    time.Duration // Latency above which the limit is decreased.
+	BackoffRatio float64       // Factor applied to the limit on decrease, between 0 and 1.
+
+	mu    sync.Mutex
+	limit int
+}
+
+// NewAIMDLimit creates a new AIMDLimit starting at initial.
+func NewAIMDLimit(initial, minLimit, maxLimit int, threshold time.Duration) *AIMDLimit {
+	return &AIMDLimit{
+		MinLimit:     minLimit,
+		MaxLimit:     maxLimit,
+		Threshold:    threshold,
+		BackoffRatio: 0.9,
+		limit:        initial,
+	}
+}
+
+// Limit implements AdaptiveLimit.
+func (l *AIMDLimit) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// Observe implements AdaptiveLimit.
+func (l *AIMDLimit) Observe(latency time.Duration, inFlight int, dropped bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch {
+	case dropped || latency > l.Threshold:
+		l.limit = int(float64(l.limit) * l.BackoffRatio)
+	case inFlight*2 >= l.limit:
+		// Only grow the limit when it is actually being used.
+		l.limit++
+	}
+	l.limit = clampLimit(l.limit, l.MinLimit, l.MaxLimit)
+}
+
+// GradientLimit is an AdaptiveLimit based on Netflix's gradient2 algorithm. It
+// compares the short-term latency with a long-term baseline and shrinks the
+// limit proportionally when requests start queueing.
+type GradientLimit struct {
+	MinLimit  int     // Lower bound of the limit.
+	MaxLimit  int     // Upper bound of the limit.
+	Tolerance float64 // Ratio of latency increase tolerated before decreasing the limit.
+	Smoothing float64 // Weight of a new limit estimate, between 0 and 1.
+
+	mu        sync.Mutex
+	limit     float64
+	shortRTT  float64 // Exponential moving average over a few samples.
+	longRTT   float64 // Exponential moving average over many samples.
+	estimated bool
+}
+
+// Number of samples averaged in the short and long term latencies.
+const (
+	gradientShortWindow = 10
+	gradientLongWindow  = 600
+)
+
+// NewGradientLimit creates a new GradientLimit starting at initial.
+func NewGradientLimit(initial, minLimit, maxLimit int) *GradientLimit {
+	return &GradientLimit{
+		MinLimit:  minLimit,
+		MaxLimit:  maxLimit,
+		Tolerance: 1.5,
+		Smoothing: 0.2,
+		limit:     float64(initial),
+	}
+}
+
+// Limit implements AdaptiveLimit.
+func (l *GradientLimit) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+// Observe implements AdaptiveLimit. Samples without a positive latency,
+// which cannot be compared with the baseline, are ignored.
+func (l *GradientLimit) Observe(latency time.Duration, inFlight int, dropped bool) {
+	if latency <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rtt := float64(latency)
+	if !l.estimated {
+		l.shortRTT, l.longRTT, l.estimated = rtt, rtt, true
+	}
+	l.shortRTT += (rtt - l.shortRTT) * 2 / (gradientShortWindow + 1)
+	l.longRTT += (rtt - l.longRTT) * 2 / (gradientLongWindow + 1)
+
+	// Let the baseline recover quickly after a sustained latency drop.
+	if l.longRTT/l.shortRTT > 2 {
+		l.longRTT *= 0.95
+	}
+
+	// Don't grow the limit while it is not being used.
+	if !dropped && float64(inFlight) < l.limit/2 {
+		return
+	}
+
+	gradient := math.Max(0.5, math.Min(1, l.Tolerance*l.longRTT/l.shortRTT))
+	if dropped {
+		gradient = 0.5
+	}
+	estimate := l.limit*gradient + math.Sqrt(l.limit)
+	limit := l.limit*(1-l.Smoothing) + estimate*l.Smoothing
+	if math.IsNaN(limit) || math.IsInf(limit, 0) {
+		return
+	}
+	if l.MaxLimit > 0 {
+		limit = math.Min(limit, float64(l.MaxLimit))
+	}
+	l.limit = math.Max(limit, math.Max(1, float64(l.MinLimit)))
+}
+
+// clampLimit bounds limit between minLimit and maxLimit.
+func clampLimit(limit, minLimit, maxLimit int) int {
+	if maxLimit > 0 && limit > maxLimit {
+		limit = maxLimit
+	}
+	if limit < minLimit {
+		limit = minLimit
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	return limit
+}
+
+// Priority is the priority class of a request. Requests of lower priority are
+// shed first when the adaptive limit is reached.
+type Priority int
+
+const (
+	// PriorityNormal requests may use 90% of the limit.
+	PriorityNormal Priority = iota
+	// PriorityLow requests may use 50% of the limit.
+	PriorityLow
+	// PriorityCritical requests, such as health checks, may use the whole limit.
+	PriorityCritical
+)
+
+// String returns the name of the priority.
+func (p Priority) String() string {
+	switch p {
+	case PriorityNormal:
+		return "normal"
+	case PriorityLow:
+		return "low"
+	case PriorityCritical:
+		return "critical"
+	default:
+		return "unknown"
+	}
+}
+
+// defaultPriorityShares is the share of the limit available to each priority.
+var defaultPriorityShares = map[Priority]float64{
+	PriorityLow:      0.5,
+	PriorityNormal:   0.9,
+	PriorityCritical: 1,
+}
+
+// PriorityByPath returns a priority function assigning priorities to exact
+// request paths, and PriorityNormal to other requests.
+func PriorityByPath(paths map[string]Priority) func(r *http.Request) Priority {
+	return func(r *http.Request) Priority {
+		if p, ok := paths[r.URL.Path]; ok {
+			return p
+		}
+		return PriorityNormal
+	}
+}
+
+// AdaptiveLimitMiddleware is a middleware that sheds load based on latency. It
+// measures each request and lets an AdaptiveLimit adjust the number of
+// requests handled concurrently, rejecting requests above it with 503.
+//
+// The middleware implements prometheus.Collector.
+type AdaptiveLimitMiddleware struct {
+	Next          http.Handler
+	Skipper       httplib.Matcher                // Skips the middleware for matching requests.
+	Limit         AdaptiveLimit                  // Algorithm adjusting the concurrency limit.
+	Priority      func(r *http.Request) Priority // Classifies requests. Defaults to PriorityNormal.
+	Shares        map[Priority]float64           // Share of the limit available to each priority.
+	RejectHandler http.Handler                   // Writes the response to shed requests. Defaults to a plain 503.
+
+	mu       sync.Mutex
+	inFlight int
+	rejected sync.Map // Rejections by priority, as *atomic.Int64.
+}
+
+var (
+	adaptiveLimitDesc = prometheus.NewDesc(
+		"http_adaptive_concurrency_limit",
+		"Current adaptive concurrency limit",
+		nil, nil,
+	)
+	adaptiveInFlightDesc = prometheus.NewDesc(
+		"http_adaptive_in_flight_requests",
+		"Number of requests currently handled",
+		nil, nil,
+	)
+	adaptiveRejectedDesc = prometheus.NewDesc(
+		"http_adaptive_rejected_requests_total",
+		"Number of requests shed by the adaptive limiter",
+		[]string{"priority"}, nil,
+	)
+)
+
+// NewAdaptiveLimitMiddleware creates a new AdaptiveLimitMiddleware instance.
+func NewAdaptiveLimitMiddleware(next http.Handler, limit AdaptiveLimit) *AdaptiveLimitMiddleware {
+	return &AdaptiveLimitMiddleware{
+		Next:  next,
+		Limit: limit,
+	}
+}
+
+// ServeHTTP is the middleware handler function that enforces the adaptive limit.
+func (m *AdaptiveLimitMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.serve(m.Next, w, r)
+}
+
+// Handler returns a handler that enforces the adaptive limit before passing
+// requests to next. The handlers returned by successive calls share the
+// limit and the in-flight requests of m, so that it can be used with
+// httplib.Use and httplib.Chain.
+func (m *AdaptiveLimitMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.serve(next, w, r)
+	})
+}
+
+// serve enforces the adaptive limit before passing the request to next.
+func (m *AdaptiveLimitMiddleware) serve(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	if m.Skipper != nil && m.Skipper(r) {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	priority := PriorityNormal
+	if m.Priority != nil {
+		priority = m.Priority(r)
+	}
+
+	inFlight, ok := m.acquire(priority)
+	if !ok {
+		counter, _ := m.rejected.LoadOrStore(priority, &atomic.Int64{})
+		counter.(*atomic.Int64).Add(1)
+		if m.RejectHandler != nil {
+			m.RejectHandler.ServeHTTP(w, r)
+		} else {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		}
+		return
+	}
+
+	startTime := time.Now()
+	defer func() {
+		m.mu.Lock()
+		m.inFlight--
+		m.mu.Unlock()
+
+		m.Limit.Observe(time.Since(startTime), inFlight, r.Context().Err() != nil)
+	}()
+
+	next.ServeHTTP(w, r)
+}
+
+// acquire admits a request of the given priority if its share of the limit is
+// not exhausted, and returns the number of requests in flight.
+func (m *AdaptiveLimitMiddleware) acquire(priority Priority) (int, bool) {
+	shares := m.Shares
+	if shares == nil {
+		shares = defaultPriorityShares
+	}
+	share, ok := shares[priority]
+	if !ok {
+		share = 1
+	}
+
+	limit := float64(m.Limit.Limit()) * share
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if float64(m.inFlight) >= math.Max(1, math.Floor(limit)) {
+		return m.inFlight, false
+	}
+	m.inFlight++
+	return m.inFlight, true
+}
+
+// Describe implements prometheus.Collector.
+func (m *AdaptiveLimitMiddleware) Describe(ch chan<- *prometheus.Desc) {
+	ch <- adaptiveLimitDesc
+	ch <- adaptiveInFlightDesc
+	ch <- adaptiveRejectedDesc
+}
+
+// Collect implements prometheus.Collector.
+func (m *AdaptiveLimitMiddleware) Collect(ch chan<- prometheus.Metric) {
+	m.mu.Lock()
+	inFlight := m.inFlight
+	m.mu.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(adaptiveLimitDesc, prometheus.GaugeValue, float64(m.Limit.Limit()))
+	ch <- prometheus.MustNewConstMetric(adaptiveInFlightDesc, prometheus.GaugeValue, float64(inFlight))
+	m.rejected.Range(func(key, value interface{}) bool {
+		ch <- prometheus.MustNewConstMetric(adaptiveRejectedDesc, prometheus.CounterValue, float64(value.(*atomic.Int64).Load()), key.(Priority).String())
+		return true
+	})
+}
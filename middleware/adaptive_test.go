@@ -0,0 +1,107 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lab42/httplib/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAIMDLimit(t *testing.T) {
+	limit := middleware.NewAIMDLimit(10, 5, 12, 100*time.Millisecond)
+
+	// Fast requests grow a limit that is in use, up to the maximum.
+	for i := 0; i < 5; i++ {
+		limit.Observe(10*time.Millisecond, 10, false)
+	}
+	assert.Equal(t, 12, limit.Limit())
+
+	// An unused limit does not grow.
+	limit.Observe(10*time.Millisecond, 1, false)
+	assert.Equal(t, 12, limit.Limit())
+
+	// Slow or dropped requests back off multiplicatively, down to the minimum.
+	limit.Observe(200*time.Millisecond, 12, false)
+	assert.Equal(t, 10, limit.Limit())
+	for i := 0; i < 10; i++ {
+		limit.Observe(10*time.Millisecond, 10, true)
+	}
+	assert.Equal(t, 5, limit.Limit())
+}
+
+func TestGradientLimit(t *testing.T) {
+	limit := middleware.NewGradientLimit(20, 5, 100)
+
+	// Stable latency lets the limit grow.
+	for i := 0; i < 50; i++ {
+		limit.Observe(10*time.Millisecond, limit.Limit(), false)
+	}
+	grown := limit.Limit()
+	assert.Greater(t, grown, 20)
+
+	// A latency spike shrinks it.
+	for i := 0; i < 20; i++ {
+		limit.Observe(100*time.Millisecond, limit.Limit(), false)
+	}
+	assert.Less(t, limit.Limit(), grown)
+	assert.GreaterOrEqual(t, limit.Limit(), 5)
+}
+
+func TestGradientLimitZeroLatency(t *testing.T) {
+	limit := middleware.NewGradientLimit(1, 1, 10)
+
+	// Zero latencies are ignored rather than poisoning the limit.
+	limit.Observe(0, 1, false)
+	assert.Equal(t, 1, limit.Limit())
+
+	// The limit still adapts to the next samples.
+	for i := 0; i < 20; i++ {
+		limit.Observe(10*time.Millisecond, limit.Limit(), false)
+	}
+	assert.Greater(t, limit.Limit(), 1)
+}
+
+func TestAdaptiveLimitMiddleware_Priority(t *testing.T) {
+	handler := newBlockingHandler()
+	defer close(handler.release)
+
+	// A fixed limit of 2 leaves a single slot to normal requests.
+	limiter := middleware.NewAdaptiveLimitMiddleware(handler, middleware.NewAIMDLimit(2, 2, 2, time.Second))
+	limiter.Priority = middleware.PriorityByPath(map[string]middleware.Priority{"/healthz": middleware.PriorityCritical})
+
+	go limiter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	<-handler.started
+
+	// Normal requests are shed first.
+	rr := httptest.NewRecorder()
+	limiter.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+
+	// Health checks still get through.
+	go limiter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/healthz", nil))
+	select {
+	case <-handler.started:
+	case <-time.After(time.Second):
+		t.Error("Expected critical request to be handled")
+	}
+}
+
+func TestAdaptiveLimitMiddleware_Handler(t *testing.T) {
+	handler := newBlockingHandler()
+	defer close(handler.release)
+
+	// A fixed limit of 1 admits a single request at a time.
+	limiter := middleware.NewAdaptiveLimitMiddleware(nil, middleware.NewAIMDLimit(1, 1, 1, time.Second))
+
+	// Occupy the only slot through a first wrapped handler.
+	go limiter.Handler(handler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	<-handler.started
+
+	// Handlers wrapped by the same middleware share its limit.
+	rr := httptest.NewRecorder()
+	limiter.Handler(http.NotFoundHandler()).ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+}
@@ -0,0 +1,206 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lab42/httplib"
+)
+
+// Apache access-log formats.
+const (
+	// CommonLogFormat is the NCSA Common Log Format.
+	CommonLogFormat = `%h %l %u %t "%r" %>s %b`
+	// CombinedLogFormat is the NCSA Combined Log Format.
+	CombinedLogFormat = `%h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-Agent}i"`
+)
+
+// ApacheLogMiddleware is a middleware that writes one line per HTTP request
+// rendered from an Apache mod_log_config format, such as CommonLogFormat.
+//
+// The supported directives are %h (remote IP), %l (always "-"), %u (basic
+// auth user), %t (request time), %r (request line), %s and %>s (status), %b
+// (body bytes, "-" when empty), %B (body bytes), %D (duration in
+// microseconds), %T (duration in seconds), %m (method), %U (path), %q (query
+// string), %H (protocol), %{Name}i (request header), %{Name}o (response
+// header) and %% (percent sign). Other directives are written as is.
+type ApacheLogMiddleware struct {
+	Next    http.Handler
+	Skipper httplib.Matcher // Skips the middleware for matching requests.
+	Format  string          // Format of the lines. Defaults to CommonLogFormat.
+	Output  io.Writer       // Destination of the lines, written with one call each. It must be safe for concurrent use, like a LogFile.
+}
+
+// NewApacheLogMiddleware creates a new ApacheLogMiddleware instance.
+func NewApacheLogMiddleware(next http.Handler, format string, output io.Writer) *ApacheLogMiddleware {
+	return &ApacheLogMiddleware{Next: next, Format: format, Output: output}
+}
+
+// ApacheLogOption configures an ApacheLogMiddleware.
+type ApacheLogOption func(*ApacheLogMiddleware)
+
+// WithApacheLogSkipper skips the middleware for requests matching skipper.
+func WithApacheLogSkipper(skipper httplib.Matcher) ApacheLogOption {
+	return func(m *ApacheLogMiddleware) {
+		m.Skipper = skipper
+	}
+}
+
+// WithApacheLogFormat sets the format of the lines.
+func WithApacheLogFormat(format string) ApacheLogOption {
+	return func(m *ApacheLogMiddleware) {
+		m.Format = format
+	}
+}
+
+// ApacheLog returns a middleware that writes Apache formatted access-log
+// lines to output, in the Common Log Format by default.
+func ApacheLog(output io.Writer, opts ...ApacheLogOption) func(http.Handler) http.Handler {
+	template := NewApacheLogMiddleware(nil, CommonLogFormat, output)
+	for _, opt := range opts {
+		opt(template)
+	}
+
+	return chainable(template, func(m *ApacheLogMiddleware, next http.Handler) {
+		m.Next = next
+	})
+}
+
+// ServeHTTP is the middleware handler function that writes the access-log line.
+func (m *ApacheLogMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.Skipper != nil && m.Skipper(r) {
+		m.Next.ServeHTTP(w, r)
+		return
+	}
+
+	start := time.Now()
+	rw := httplib.NewResponseWriter(w)
+
+	// Call the next handler in the chain
+	m.Next.ServeHTTP(rw, r)
+
+	format := m.Format
+	if format == "" {
+		format = CommonLogFormat
+	}
+
+	var line bytes.Buffer
+	renderApacheLog(&line, format, r, rw, start, time.Since(start))
+	line.WriteByte('\n')
+	m.Output.Write(line.Bytes())
+}
+
+// renderApacheLog renders format for the request r answered through rw.
+func renderApacheLog(buf *bytes.Buffer, format string, r *http.Request, rw httplib.ResponseWriter, start time.Time, duration time.Duration) {
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' || i+1 == len(format) {
+			buf.WriteByte(c)
+			continue
+		}
+
+		// Parse the directive, with its optional {argument} and > modifier.
+		j := i + 1
+		var arg string
+		if format[j] == '{' {
+			end := strings.IndexByte(format[j:], '}')
+			if end < 0 {
+				buf.WriteString(format[i:])
+				return
+			}
+			arg = format[j+1 : j+end]
+			j += end + 1
+		}
+		if j < len(format) && (format[j] == '>' || format[j] == '<') {
+			j++
+		}
+		if j == len(format) {
+			buf.WriteString(format[i:])
+			return
+		}
+
+		switch format[j] {
+		case '%':
+			buf.WriteByte('%')
+		case 'h':
+			buf.WriteString(clientIP(r))
+		case 'l':
+			buf.WriteByte('-')
+		case 'u':
+			if user, _, ok := r.BasicAuth(); ok && user != "" {
+				writeApacheEscaped(buf, user)
+			} else {
+				buf.WriteByte('-')
+			}
+		case 't':
+			buf.WriteString(start.Format("[02/Jan/2006:15:04:05 -0700]"))
+		case 'r':
+			writeApacheEscaped(buf, r.Method+" "+r.URL.RequestURI()+" "+r.Proto)
+		case 's':
+			buf.WriteString(strconv.Itoa(rw.Status()))
+		case 'b':
+			if rw.BytesWritten() == 0 {
+				buf.WriteByte('-')
+			} else {
+				buf.WriteString(strconv.FormatInt(rw.BytesWritten(), 10))
+			}
+		case 'B':
+			buf.WriteString(strconv.FormatInt(rw.BytesWritten(), 10))
+		case 'D':
+			buf.WriteString(strconv.FormatInt(duration.Microseconds(), 10))
+		case 'T':
+			buf.WriteString(strconv.FormatInt(int64(duration/time.Second), 10))
+		case 'm':
+			buf.WriteString(r.Method)
+		case 'U':
+			writeApacheEscaped(buf, r.URL.EscapedPath())
+		case 'q':
+			if r.URL.RawQuery != "" {
+				buf.WriteByte('?')
+				writeApacheEscaped(buf, r.URL.RawQuery)
+			}
+		case 'H':
+			buf.WriteString(r.Proto)
+		case 'i':
+			writeApacheHeader(buf, r.Header.Get(arg))
+		case 'o':
+			writeApacheHeader(buf, rw.Header().Get(arg))
+		default:
+			buf.WriteString(format[i : j+1])
+		}
+		i = j
+	}
+}
+
+// writeApacheHeader writes a header value, "-" when empty.
+func writeApacheHeader(buf *bytes.Buffer, value string) {
+	if value == "" {
+		buf.WriteByte('-')
+		return
+	}
+	writeApacheEscaped(buf, value)
+}
+
+// writeApacheEscaped writes s with quotes, backslashes and non-printable
+// characters escaped like Apache does, so that a line cannot be forged.
+func writeApacheEscaped(buf *bytes.Buffer, s string) {
+	const hex = "0123456789abcdef"
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			buf.WriteString(`\x`)
+			buf.WriteByte(hex[c>>4])
+			buf.WriteByte(hex[c&0xf])
+		default:
+			buf.WriteByte(c)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package middleware_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lab42/httplib/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+// helloHandler writes a fixed body with a response header.
+var helloHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Cache", "HIT")
+	w.Write([]byte("Hello, World!"))
+})
+
+func TestApacheLogMiddlewareCommon(t *testing.T) {
+	var buf bytes.Buffer
+
+	// Create an ApacheLogMiddleware instance.
+	m := middleware.NewApacheLogMiddleware(helloHandler, middleware.CommonLogFormat, &buf)
+
+	// Create a test request.
+	req := httptest.NewRequest(http.MethodGet, "/index.html?lang=en", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.SetBasicAuth("frank", "secret")
+
+	// Execute the middleware.
+	m.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Regexp(t, `^192\.0\.2\.1 - frank \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /index\.html\?lang=en HTTP/1\.1" 200 13\n$`, buf.String())
+}
+
+func TestApacheLogMiddlewareCombined(t *testing.T) {
+	var buf bytes.Buffer
+
+	// Create an Apache log middleware using the Combined Log Format.
+	m := middleware.ApacheLog(&buf, middleware.WithApacheLogFormat(middleware.CombinedLogFormat))(http.NotFoundHandler())
+
+	// Create a test request.
+	req := httptest.NewRequest(http.MethodPost, "/missing", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("User-Agent", `Mozilla/5.0 "quoted"`)
+
+	// Execute the middleware.
+	m.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Regexp(t, `^192\.0\.2\.1 - - \[[^\]]+\] "POST /missing HTTP/1\.1" 404 19 "-" "Mozilla/5\.0 \\"quoted\\""\n$`, buf.String())
+}
+
+func TestApacheLogMiddlewareCustomFormat(t *testing.T) {
+	var buf bytes.Buffer
+
+	// Create an Apache log middleware using a custom format.
+	format := `%m %U%q %H %>s %B %{X-Request-ID}i %{X-Cache}o %Dus %Ts %% %z`
+	m := middleware.ApacheLog(&buf, middleware.WithApacheLogFormat(format))(helloHandler)
+
+	// Create a test request.
+	req := httptest.NewRequest(http.MethodGet, "/search?q=go", nil)
+	req.Header.Set("X-Request-ID", "req\n1")
+
+	// Execute the middleware.
+	m.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Regexp(t, `^GET /search\?q=go HTTP/1\.1 200 13 req\\x0a1 HIT \d+us 0s % %z\n$`, buf.String())
+}
+
+func TestApacheLogMiddlewareEmptyBody(t *testing.T) {
+	var buf bytes.Buffer
+
+	// Create a handler writing no body.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// Execute the middleware.
+	middleware.ApacheLog(&buf, middleware.WithApacheLogFormat("%>s %b %B %{Referer}i"))(handler).
+		ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/", nil))
+
+	assert.Equal(t, "204 - 0 -\n", buf.String())
+}
@@ -0,0 +1,178 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/lab42/httplib"
+)
+
+// DefaultBodyCaptureMaxBytes is the default maximum number of bytes captured per body.
+const DefaultBodyCaptureMaxBytes = 4096
+
+// DefaultBodyCaptureContentTypes are the media types of the bodies captured by default.
+var DefaultBodyCaptureContentTypes = []string{
+	"application/json",
+	"application/*+json",
+	"application/x-www-form-urlencoded",
+	"text/*",
+}
+
+// BodyCapture configures the capture of the request and response bodies by
+// the access-log middlewares. Bodies are teed while the handler reads and
+// writes them, so that capturing never consumes them, and are redacted
+// before being logged: JSON bodies are logged as JSON values, form bodies as
+// parameters and text bodies as strings. Bodies with a content encoding, such
+// as gzip, are not captured.
+type BodyCapture struct {
+	MaxBytes     int      // Maximum number of bytes captured per body. Defaults to DefaultBodyCaptureMaxBytes.
+	ContentTypes []string // Media types of the captured bodies, globs such as "text/*" are supported. Defaults to DefaultBodyCaptureContentTypes.
+}
+
+// captures reports whether bodies of the given content type are captured.
+func (c *BodyCapture) captures(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	contentTypes := c.ContentTypes
+	if contentTypes == nil {
+		contentTypes = DefaultBodyCaptureContentTypes
+	}
+	for _, pattern := range contentTypes {
+		if ok, _ := path.Match(strings.ToLower(pattern), mediaType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// capturesHeader reports whether the body described by header is captured:
+// it has a captured content type and no content encoding.
+func (c *BodyCapture) capturesHeader(header http.Header) bool {
+	return header.Get("Content-Encoding") == "" && c.captures(header.Get("Content-Type"))
+}
+
+// newBuffer returns a buffer capturing up to the maximum number of bytes.
+func (c *BodyCapture) newBuffer() *bodyBuffer {
+	maxBytes := c.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultBodyCaptureMaxBytes
+	}
+	return &bodyBuffer{max: maxBytes}
+}
+
+// bodyBuffer is a writer keeping the first bytes written to it.
+type bodyBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+// Write keeps the bytes of p fitting in the buffer. It never fails, so that
+// the capture does not interfere with the body it tees.
+func (b *bodyBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); len(p) > room {
+		b.buf.Write(p[:room])
+		b.truncated = true
+	} else {
+		b.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+// teeReadCloser is a request body teeing what the handler reads.
+type teeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// captureRequestBody replaces the body of r by one teeing what the handler
+// reads, and returns the capture buffer. It returns nil when the body is not
+// captured.
+func (c *BodyCapture) captureRequestBody(r *http.Request) *bodyBuffer {
+	if r.Body == nil || r.Body == http.NoBody || !c.capturesHeader(r.Header) {
+		return nil
+	}
+	buf := c.newBuffer()
+	r.Body = teeReadCloser{io.TeeReader(r.Body, buf), r.Body}
+	return buf
+}
+
+// responseCapture is the tee of a response body. Whether the body is captured
+// is decided at the first write, when the response headers are final, so
+// that bodies that are not captured are never buffered.
+type responseCapture struct {
+	capture *BodyCapture
+	header  http.Header
+	decided bool
+	buf     *bodyBuffer
+}
+
+// captureResponseBody returns the tee capturing the body of the response
+// whose headers are header.
+func (c *BodyCapture) captureResponseBody(header http.Header) *responseCapture {
+	return &responseCapture{capture: c, header: header}
+}
+
+// Write captures p when the response body is captured. It never fails.
+func (c *responseCapture) Write(p []byte) (int, error) {
+	if !c.decided {
+		c.decided = true
+		if c.capture.capturesHeader(c.header) {
+			c.buf = c.capture.newBuffer()
+		}
+	}
+	if c.buf != nil {
+		c.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+// bodyFields returns the access-log fields describing a captured body of the
+// given content type, named after prefix. Nothing is returned when the body
+// is empty or not captured.
+func bodyFields(prefix string, buf *bodyBuffer, contentType string, redactor *httplib.Redactor) []accessLogField {
+	if buf == nil || buf.buf.Len() == 0 {
+		return nil
+	}
+
+	fields := []accessLogField{{prefix, redactBody(buf, contentType, redactor)}}
+	if buf.truncated {
+		fields = append(fields, accessLogField{prefix + "_truncated", true})
+	}
+	return fields
+}
+
+// redactBody returns the captured body redacted by redactor: JSON values for
+// JSON bodies, parameters for form bodies and redacted text otherwise.
+func redactBody(buf *bodyBuffer, contentType string, redactor *httplib.Redactor) interface{} {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	body := buf.buf.Bytes()
+
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		// Truncated or invalid documents cannot be redacted by key.
+		redacted, err := redactor.JSON(body)
+		if err != nil {
+			return httplib.Redacted
+		}
+		decoder := json.NewDecoder(bytes.NewReader(redacted))
+		decoder.UseNumber()
+		var value interface{}
+		decoder.Decode(&value)
+		return value
+	case mediaType == "application/x-www-form-urlencoded":
+		values, _ := url.ParseQuery(string(body))
+		return redactor.Values(values)
+	default:
+		return redactor.Text(string(body))
+	}
+}
@@ -0,0 +1,175 @@
+package middleware_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lab42/httplib/middleware"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBodyCaptureJSON(t *testing.T) {
+	var buf bytes.Buffer
+
+	// Create a handler echoing the request body.
+	var received string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write([]byte(`{"id":42,"token":"abc"}`))
+	})
+
+	// Create a ZeroLog middleware capturing the bodies.
+	m := middleware.ZeroLog(
+		middleware.WithZeroLogLogger(zerolog.New(&buf)),
+		middleware.WithZeroLogSensitiveKeys("password", "token"),
+		middleware.WithZeroLogAccessLog(middleware.WithAccessLogBodyCapture(1024)),
+	)(handler)
+
+	// Create a test request with a JSON body.
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username":"john","password":"secret"}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	// Execute the middleware.
+	m.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Check that the handler read the whole body.
+	assert.Equal(t, `{"username":"john","password":"secret"}`, received)
+
+	events := zerologEvents(t, &buf)
+	assert.Equal(t, map[string]interface{}{"username": "john", "password": "********"}, events[0]["request_body"])
+	assert.Equal(t, map[string]interface{}{"id": float64(42), "token": "********"}, events[0]["response_body"])
+	assert.NotContains(t, events[0], "request_body_truncated")
+}
+
+func TestBodyCaptureTruncated(t *testing.T) {
+	var buf bytes.Buffer
+
+	// Create a handler reading the request body and writing a long text.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("Hello, World!"))
+	})
+
+	// Create a ZeroLog middleware capturing 5 bytes per body.
+	m := middleware.ZeroLog(
+		middleware.WithZeroLogLogger(zerolog.New(&buf)),
+		middleware.WithZeroLogAccessLog(middleware.WithAccessLogBodyCapture(5)),
+	)(handler)
+
+	// Create a test request with a JSON body.
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"password":"secret"}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	// Execute the middleware.
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, req)
+
+	// Check that the response was written in full.
+	assert.Equal(t, "Hello, World!", rr.Body.String())
+
+	// Truncated JSON bodies cannot be redacted by key, so they are masked.
+	events := zerologEvents(t, &buf)
+	assert.Equal(t, "********", events[0]["request_body"])
+	assert.Equal(t, true, events[0]["request_body_truncated"])
+	assert.Equal(t, "Hello", events[0]["response_body"])
+	assert.Equal(t, true, events[0]["response_body_truncated"])
+}
+
+func TestBodyCaptureContentTypes(t *testing.T) {
+	var buf bytes.Buffer
+
+	// Create a handler parsing the form and writing an image.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG"))
+	})
+
+	// Create a ZeroLog middleware capturing form bodies only.
+	m := middleware.ZeroLog(
+		middleware.WithZeroLogLogger(zerolog.New(&buf)),
+		middleware.WithZeroLogSensitiveKeys("password"),
+		middleware.WithZeroLogAccessLog(middleware.WithAccessLogBodyCapture(1024, "application/x-www-form-urlencoded")),
+	)(handler)
+
+	// Create a test request with a form body.
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("username=john&password=secret"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// Execute the middleware.
+	m.ServeHTTP(httptest.NewRecorder(), req)
+
+	events := zerologEvents(t, &buf)
+	assert.Equal(t, map[string]interface{}{"username": "john", "password": "********"}, events[0]["request_body"])
+	assert.NotContains(t, events[0], "response_body")
+}
+
+func TestBodyCaptureContentEncoding(t *testing.T) {
+	var buf bytes.Buffer
+
+	// Create a handler reading the request body and writing a JSON response.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":42}`))
+	})
+
+	// Create a ZeroLog middleware capturing the bodies, compressed by a Gzip middleware.
+	m := middleware.ZeroLog(
+		middleware.WithZeroLogLogger(zerolog.New(&buf)),
+		middleware.WithZeroLogAccessLog(middleware.WithAccessLogBodyCapture(1024)),
+	)(middleware.Gzip()(handler))
+
+	// Create a test request with a gzip-encoded JSON body.
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("\x1f\x8b\x08\x00"))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	// Execute the middleware.
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, req)
+
+	// Check that the encoded bodies are not captured.
+	assert.Equal(t, "gzip", rr.Header().Get("Content-Encoding"))
+	events := zerologEvents(t, &buf)
+	assert.NotContains(t, events[0], "request_body")
+	assert.NotContains(t, events[0], "response_body")
+}
+
+func TestBodyCaptureText(t *testing.T) {
+	var buf bytes.Buffer
+
+	// Create a handler reading the request body and writing a text response.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("token: abc\nsent to john@example.com"))
+	})
+
+	// Create a ZeroLog middleware capturing the bodies.
+	m := middleware.ZeroLog(
+		middleware.WithZeroLogLogger(zerolog.New(&buf)),
+		middleware.WithZeroLogAccessLog(middleware.WithAccessLogBodyCapture(1024)),
+	)(handler)
+
+	// Create a test request with a text body.
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("password=secret"))
+	req.Header.Set("Content-Type", "text/plain")
+
+	// Execute the middleware.
+	m.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Check that the text bodies are redacted.
+	events := zerologEvents(t, &buf)
+	assert.Equal(t, "password=********", events[0]["request_body"])
+	assert.Equal(t, "token: ********\nsent to ********", events[0]["response_body"])
+}
@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Label values substituted by the CardinalityLimiter.
+const (
+	OtherLabelValue    = "__other__"     // Replaces label values past the limit.
+	NotFoundLabelValue = "__not_found__" // Replaces the route of requests answered with 404.
+)
+
+// CardinalityLimiter caps the number of distinct values each metric label
+// takes, so that requests to random URLs cannot create unbounded series. The
+// first MaxValues values seen for a label are kept, later ones are folded
+// into OtherLabelValue. A limiter can be shared by the PrometheusMiddleware
+// and the DatadogMiddleware.
+//
+// The limiter implements prometheus.Collector, reporting how many values
+// were folded per label.
+type CardinalityLimiter struct {
+	MaxValues        int  // Maximum number of distinct values per label. Zero means unlimited.
+	CollapseNotFound bool // Reports the route of every 404 response as NotFoundLabelValue.
+
+	mu     sync.RWMutex
+	values map[string]map[string]struct{}
+	folded map[string]uint64
+}
+
+var cardinalityFoldedDesc = prometheus.NewDesc(
+	"http_metric_label_values_folded_total",
+	"Number of label values folded by the cardinality limiter",
+	[]string{"label"}, nil,
+)
+
+// NewCardinalityLimiter creates a new CardinalityLimiter instance collapsing
+// 404 routes.
+func NewCardinalityLimiter(maxValues int) *CardinalityLimiter {
+	return &CardinalityLimiter{
+		MaxValues:        maxValues,
+		CollapseNotFound: true,
+	}
+}
+
+// Value returns the value to report for label, and whether value was folded.
+func (l *CardinalityLimiter) Value(label, value string) (string, bool) {
+	if l.MaxValues <= 0 {
+		return value, false
+	}
+
+	l.mu.RLock()
+	_, ok := l.values[label][value]
+	l.mu.RUnlock()
+	if ok {
+		return value, false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.values == nil {
+		l.values = make(map[string]map[string]struct{})
+		l.folded = make(map[string]uint64)
+	}
+	values := l.values[label]
+	if values == nil {
+		values = make(map[string]struct{})
+		l.values[label] = values
+	}
+	if _, ok := values[value]; ok {
+		return value, false
+	}
+	if len(values) >= l.MaxValues {
+		l.folded[label]++
+		return OtherLabelValue, true
+	}
+	values[value] = struct{}{}
+	return value, false
+}
+
+// Route returns the route to report for a response with the given status,
+// and whether route was folded.
+func (l *CardinalityLimiter) Route(route string, status int) (string, bool) {
+	if l.CollapseNotFound && status == http.StatusNotFound {
+		return NotFoundLabelValue, false
+	}
+	return l.Value("route", route)
+}
+
+// Folded returns the number of values folded for label.
+func (l *CardinalityLimiter) Folded(label string) uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.folded[label]
+}
+
+// Describe implements prometheus.Collector.
+func (l *CardinalityLimiter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cardinalityFoldedDesc
+}
+
+// Collect implements prometheus.Collector.
+func (l *CardinalityLimiter) Collect(ch chan<- prometheus.Metric) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for label, folded := range l.folded {
+		ch <- prometheus.MustNewConstMetric(cardinalityFoldedDesc, prometheus.CounterValue, float64(folded), label)
+	}
+}
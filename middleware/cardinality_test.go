@@ -0,0 +1,79 @@
+package middleware_test
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lab42/httplib/middleware"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCardinalityLimiter(t *testing.T) {
+	limiter := middleware.NewCardinalityLimiter(2)
+
+	// The first values of a label are kept.
+	for _, value := range []string{"/a", "/b", "/a"} {
+		got, folded := limiter.Value("route", value)
+		assert.Equal(t, value, got)
+		assert.False(t, folded)
+	}
+
+	// Values past the limit are folded.
+	got, folded := limiter.Value("route", "/c")
+	assert.Equal(t, middleware.OtherLabelValue, got)
+	assert.True(t, folded)
+
+	// Labels are limited independently.
+	got, _ = limiter.Value("method", "GET")
+	assert.Equal(t, "GET", got)
+
+	assert.Equal(t, uint64(1), limiter.Folded("route"))
+	assert.Equal(t, uint64(0), limiter.Folded("method"))
+
+	expected := `
+# HELP http_metric_label_values_folded_total Number of label values folded by the cardinality limiter
+# TYPE http_metric_label_values_folded_total counter
+http_metric_label_values_folded_total{label="route"} 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(limiter, strings.NewReader(expected)))
+}
+
+func TestCardinalityLimiterRoute(t *testing.T) {
+	limiter := middleware.NewCardinalityLimiter(1)
+
+	// 404 responses are collapsed without consuming a value.
+	route, folded := limiter.Route("/random/path", http.StatusNotFound)
+	assert.Equal(t, middleware.NotFoundLabelValue, route)
+	assert.False(t, folded)
+
+	route, _ = limiter.Route("/users", http.StatusOK)
+	assert.Equal(t, "/users", route)
+
+	route, folded = limiter.Route("/orders", http.StatusOK)
+	assert.Equal(t, middleware.OtherLabelValue, route)
+	assert.True(t, folded)
+
+	// Collapsing 404 responses can be disabled.
+	limiter = &middleware.CardinalityLimiter{}
+	route, _ = limiter.Route("/random/path", http.StatusNotFound)
+	assert.Equal(t, "/random/path", route)
+}
+
+func TestCardinalityLimiterConcurrent(t *testing.T) {
+	limiter := middleware.NewCardinalityLimiter(10)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			limiter.Value("route", strings.Repeat("x", i))
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, uint64(90), limiter.Folded("route"))
+}
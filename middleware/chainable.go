@@ -0,0 +1,23 @@
+package middleware
+
+import "net/http"
+
+// chainable returns a constructor of middlewares usable with httplib.Use and
+// httplib.Chain: each call copies the configured template and sets the next
+// handler of the copy with setNext.
+//
+// The copy goes through a type parameter, which go vet's copylocks check
+// cannot see. Templates must therefore never be served, so that their locks
+// and sync.Once fields are still zero when copied, and middlewares whose
+// state must be shared between handlers, such as the concurrency limiters,
+// must not use chainable.
+func chainable[T any, PT interface {
+	*T
+	http.Handler
+}](template PT, setNext func(PT, http.Handler)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		m := *template
+		setNext(&m, next)
+		return PT(&m)
+	}
+}
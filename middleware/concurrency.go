@@ -0,0 +1,213 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lab42/httplib"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ConcurrencyLimitMiddleware is a middleware that caps the number of requests
+// handled concurrently, globally and per route. Excess requests wait in a
+// bounded queue for a free slot and are shed with 503 when the queue is full,
+// the wait times out or the client goes away.
+//
+// The middleware implements prometheus.Collector, so that its in-flight and
+// queued requests and its rejections can be registered alongside the metrics
+// of the PrometheusMiddleware.
+type ConcurrencyLimitMiddleware struct {
+	Next          http.Handler
+	Skipper       httplib.Matcher              // Skips the middleware for matching requests.
+	MaxInFlight   int                          // Maximum number of requests handled concurrently. Zero means unlimited.
+	RouteLimits   map[string]int               // Maximum number of requests handled concurrently per route. Zero means unlimited.
+	Route         func(r *http.Request) string // Extracts the route matched against RouteLimits. Defaults to the URL path.
+	MaxQueue      int                          // Maximum number of requests waiting for a slot.
+	QueueTimeout  time.Duration                // Maximum time a request waits for a slot. Zero means until the request is canceled.
+	RejectHandler http.Handler                 // Writes the response to shed requests. Defaults to a plain 503.
+
+	once     sync.Once
+	global   chan struct{}
+	routes   map[string]chan struct{}
+	inFlight atomic.Int64
+	queued   atomic.Int64
+	rejected [3]atomic.Int64 // Rejections by reason, indexed like rejectReasons.
+}
+
+// Reasons for shedding a request.
+const (
+	rejectQueueFull = iota
+	rejectTimeout
+	rejectCanceled
+)
+
+var rejectReasons = [...]string{"queue_full", "timeout", "canceled"}
+
+var (
+	concurrencyInFlightDesc = prometheus.NewDesc(
+		"http_concurrency_in_flight_requests",
+		"Number of requests currently handled",
+		nil, nil,
+	)
+	concurrencyQueuedDesc = prometheus.NewDesc(
+		"http_concurrency_queued_requests",
+		"Number of requests waiting for a slot",
+		nil, nil,
+	)
+	concurrencyRejectedDesc = prometheus.NewDesc(
+		"http_concurrency_rejected_requests_total",
+		"Number of requests shed by the concurrency limiter",
+		[]string{"reason"}, nil,
+	)
+)
+
+// NewConcurrencyLimitMiddleware creates a new ConcurrencyLimitMiddleware instance.
+func NewConcurrencyLimitMiddleware(next http.Handler, maxInFlight, maxQueue int, queueTimeout time.Duration) *ConcurrencyLimitMiddleware {
+	return &ConcurrencyLimitMiddleware{
+		Next:         next,
+		MaxInFlight:  maxInFlight,
+		MaxQueue:     maxQueue,
+		QueueTimeout: queueTimeout,
+	}
+}
+
+func (m *ConcurrencyLimitMiddleware) init() {
+	if m.MaxInFlight > 0 {
+		m.global = make(chan struct{}, m.MaxInFlight)
+	}
+	m.routes = make(map[string]chan struct{}, len(m.RouteLimits))
+	for route, limit := range m.RouteLimits {
+		if limit > 0 {
+			m.routes[route] = make(chan struct{}, limit)
+		}
+	}
+}
+
+// ServeHTTP is the middleware handler function that enforces the concurrency limits.
+func (m *ConcurrencyLimitMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.serve(m.Next, w, r)
+}
+
+// Handler returns a handler that enforces the concurrency limits before
+// passing requests to next. The handlers returned by successive calls share
+// the limits of m, so that it can be used with httplib.Use and httplib.Chain.
+func (m *ConcurrencyLimitMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.serve(next, w, r)
+	})
+}
+
+// serve enforces the concurrency limits before passing the request to next.
+func (m *ConcurrencyLimitMiddleware) serve(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	if m.Skipper != nil && m.Skipper(r) {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	m.once.Do(m.init)
+
+	// Acquire the route slot first, then the global one.
+	route := r.URL.Path
+	if m.Route != nil {
+		route = m.Route(r)
+	}
+	var slots []chan struct{}
+	if slot, ok := m.routes[route]; ok {
+		slots = append(slots, slot)
+	}
+	if m.global != nil {
+		slots = append(slots, m.global)
+	}
+
+	if reason, ok := m.acquire(r.Context(), slots); !ok {
+		m.rejected[reason].Add(1)
+		if m.RejectHandler != nil {
+			m.RejectHandler.ServeHTTP(w, r)
+		} else {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		}
+		return
+	}
+	defer release(slots)
+
+	m.inFlight.Add(1)
+	defer m.inFlight.Add(-1)
+
+	next.ServeHTTP(w, r)
+}
+
+// acquire acquires all slots, waiting in the queue if one of them is busy.
+// It returns the reason for shedding the request when it fails.
+func (m *ConcurrencyLimitMiddleware) acquire(ctx context.Context, slots []chan struct{}) (int, bool) {
+	// Take free slots without queueing.
+	n := 0
+	for n < len(slots) && tryAcquire(slots[n]) {
+		n++
+	}
+	if n == len(slots) {
+		return 0, true
+	}
+
+	if m.queued.Add(1) > int64(m.MaxQueue) {
+		m.queued.Add(-1)
+		release(slots[:n])
+		return rejectQueueFull, false
+	}
+	defer m.queued.Add(-1)
+
+	var timeout <-chan time.Time
+	if m.QueueTimeout > 0 {
+		timer := time.NewTimer(m.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for ; n < len(slots); n++ {
+		select {
+		case slots[n] <- struct{}{}:
+		case <-timeout:
+			release(slots[:n])
+			return rejectTimeout, false
+		case <-ctx.Done():
+			release(slots[:n])
+			return rejectCanceled, false
+		}
+	}
+	return 0, true
+}
+
+// tryAcquire acquires a slot if one is free.
+func tryAcquire(slot chan struct{}) bool {
+	select {
+	case slot <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release releases acquired slots.
+func release(slots []chan struct{}) {
+	for _, slot := range slots {
+		<-slot
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *ConcurrencyLimitMiddleware) Describe(ch chan<- *prometheus.Desc) {
+	ch <- concurrencyInFlightDesc
+	ch <- concurrencyQueuedDesc
+	ch <- concurrencyRejectedDesc
+}
+
+// Collect implements prometheus.Collector.
+func (m *ConcurrencyLimitMiddleware) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(concurrencyInFlightDesc, prometheus.GaugeValue, float64(m.inFlight.Load()))
+	ch <- prometheus.MustNewConstMetric(concurrencyQueuedDesc, prometheus.GaugeValue, float64(m.queued.Load()))
+	for i, reason := range rejectReasons {
+		ch <- prometheus.MustNewConstMetric(concurrencyRejectedDesc, prometheus.CounterValue, float64(m.rejected[i].Load()), reason)
+	}
+}
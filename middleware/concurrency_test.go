@@ -0,0 +1,150 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lab42/httplib/middleware"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingHandler blocks requests until released, signalling when each one starts.
+type blockingHandler struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingHandler() *blockingHandler {
+	return &blockingHandler{started: make(chan struct{}, 10), release: make(chan struct{})}
+}
+
+func (h *blockingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.started <- struct{}{}
+	<-h.release
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestConcurrencyLimitMiddleware_Shed(t *testing.T) {
+	handler := newBlockingHandler()
+	middleware := middleware.NewConcurrencyLimitMiddleware(handler, 1, 0, 0)
+
+	// Occupy the only slot.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+	<-handler.started
+
+	// Without a queue, the next request is shed immediately.
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+
+	close(handler.release)
+	wg.Wait()
+
+	expected := `
+		# HELP http_concurrency_rejected_requests_total Number of requests shed by the concurrency limiter
+		# TYPE http_concurrency_rejected_requests_total counter
+		http_concurrency_rejected_requests_total{reason="canceled"} 0
+		http_concurrency_rejected_requests_total{reason="queue_full"} 1
+		http_concurrency_rejected_requests_total{reason="timeout"} 0
+	`
+	assert.NoError(t, testutil.CollectAndCompare(middleware, strings.NewReader(expected), "http_concurrency_rejected_requests_total"))
+}
+
+func TestConcurrencyLimitMiddleware_Queue(t *testing.T) {
+	handler := newBlockingHandler()
+	middleware := middleware.NewConcurrencyLimitMiddleware(handler, 1, 1, time.Second)
+
+	// Occupy the only slot, then queue a second request.
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+			codes <- rr.Code
+		}()
+	}
+	<-handler.started
+	queued := `
+		# HELP http_concurrency_queued_requests Number of requests waiting for a slot
+		# TYPE http_concurrency_queued_requests gauge
+		http_concurrency_queued_requests 1
+	`
+	assert.Eventually(t, func() bool {
+		return testutil.CollectAndCompare(middleware, strings.NewReader(queued), "http_concurrency_queued_requests") == nil
+	}, time.Second, time.Millisecond)
+
+	// The queue is full, so a third request is shed.
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+
+	// Releasing the slot lets the queued request through.
+	close(handler.release)
+	assert.Equal(t, http.StatusOK, <-codes)
+	assert.Equal(t, http.StatusOK, <-codes)
+}
+
+func TestConcurrencyLimitMiddleware_QueueTimeout(t *testing.T) {
+	handler := newBlockingHandler()
+	middleware := middleware.NewConcurrencyLimitMiddleware(handler, 0, 1, 10*time.Millisecond)
+	middleware.RouteLimits = map[string]int{"/reports": 1}
+
+	go middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/reports", nil))
+	<-handler.started
+	defer close(handler.release)
+
+	// The route is busy, so the request times out in the queue.
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, httptest.NewRequest("GET", "/reports", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+
+	// Other routes are not limited.
+	go middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	select {
+	case <-handler.started:
+	case <-time.After(time.Second):
+		t.Error("Expected request to another route to be handled")
+	}
+}
+
+func TestConcurrencyLimitMiddleware_UnlimitedRoute(t *testing.T) {
+	handler := newBlockingHandler()
+	middleware := middleware.NewConcurrencyLimitMiddleware(handler, 0, 0, 10*time.Millisecond)
+	middleware.RouteLimits = map[string]int{"/health": 0}
+	defer close(handler.release)
+
+	// Routes with a zero limit are not limited.
+	for i := 0; i < 2; i++ {
+		go middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/health", nil))
+		select {
+		case <-handler.started:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected request %d to be handled", i)
+		}
+	}
+}
+
+func TestConcurrencyLimitMiddleware_Handler(t *testing.T) {
+	handler := newBlockingHandler()
+	limiter := middleware.NewConcurrencyLimitMiddleware(nil, 1, 0, 0)
+	defer close(handler.release)
+
+	// Occupy the only slot through a first wrapped handler.
+	go limiter.Handler(handler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	<-handler.started
+
+	// Handlers wrapped by the same middleware share its slots.
+	rr := httptest.NewRecorder()
+	limiter.Handler(http.NotFoundHandler()).ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+}
@@ -2,12 +2,15 @@ package middleware
 
 import (
 	"net/http"
+
+	"github.com/lab42/httplib"
 )
 
 // CSPMiddleware is a middleware that sets the Content Security Policy (CSP) header.
 type CSPMiddleware struct {
-	Next http.Handler
-	CSP  string // The CSP header value to set.
+	Next    http.Handler
+	Skipper httplib.Matcher // Skips the middleware for matching requests.
+	CSP     string          // The CSP header value to set.
 }
 
 // NewCSPMiddleware creates a new CSPMiddleware instance.
@@ -18,8 +21,35 @@ func NewCSPMiddleware(next http.Handler, csp string) *CSPMiddleware {
 	}
 }
 
+// CSPOption configures a CSPMiddleware.
+type CSPOption func(*CSPMiddleware)
+
+// WithCSPSkipper skips the middleware for requests matching skipper.
+func WithCSPSkipper(skipper httplib.Matcher) CSPOption {
+	return func(m *CSPMiddleware) {
+		m.Skipper = skipper
+	}
+}
+
+// CSP returns a middleware that sets the Content Security Policy header.
+func CSP(csp string, opts ...CSPOption) func(http.Handler) http.Handler {
+	template := NewCSPMiddleware(nil, csp)
+	for _, opt := range opts {
+		opt(template)
+	}
+
+	return chainable(template, func(m *CSPMiddleware, next http.Handler) {
+		m.Next = next
+	})
+}
+
 // ServeHTTP is the middleware handler function that sets the CSP header.
 func (m *CSPMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.Skipper != nil && m.Skipper(r) {
+		m.Next.ServeHTTP(w, r)
+		return
+	}
+
 	w.Header().Set("Content-Security-Policy", m.CSP)
 	m.Next.ServeHTTP(w, r)
 }
@@ -2,16 +2,19 @@ package middleware
 
 import (
 	"net/http"
+
+	"github.com/lab42/httplib"
 )
 
 // CSRFMiddleware is a middleware that provides Cross-Site Request Forgery (CSRF) protection.
 type CSRFMiddleware struct {
 	Next        http.Handler
-	CSRFHeader  string // The header containing the CSRF token.
-	CSRFCookie  string // The name of the CSRF token cookie.
-	CSRFParam   string // The name of the CSRF token parameter in form submissions.
-	CSRFToken   string // The expected CSRF token value.
-	ErrorStatus int    // The HTTP status code to use when CSRF validation fails (e.g., http.StatusForbidden).
+	Skipper     httplib.Matcher // Skips the middleware for matching requests.
+	CSRFHeader  string          // The header containing the CSRF token.
+	CSRFCookie  string          // The name of the CSRF token cookie.
+	CSRFParam   string          // The name of the CSRF token parameter in form submissions.
+	CSRFToken   string          // The expected CSRF token value.
+	ErrorStatus int             // The HTTP status code to use when CSRF validation fails (e.g., http.StatusForbidden).
 }
 
 // NewCSRFMiddleware creates a new CSRFMiddleware instance.
@@ -26,8 +29,63 @@ func NewCSRFMiddleware(next http.Handler, csrfHeader, csrfCookie, csrfParam, csr
 	}
 }
 
+// CSRFOption configures a CSRFMiddleware.
+type CSRFOption func(*CSRFMiddleware)
+
+// WithCSRFSkipper skips the middleware for requests matching skipper.
+func WithCSRFSkipper(skipper httplib.Matcher) CSRFOption {
+	return func(m *CSRFMiddleware) {
+		m.Skipper = skipper
+	}
+}
+
+// WithCSRFHeader sets the header containing the CSRF token. Defaults to X-CSRF-Token.
+func WithCSRFHeader(header string) CSRFOption {
+	return func(m *CSRFMiddleware) {
+		m.CSRFHeader = header
+	}
+}
+
+// WithCSRFCookie sets the name of the CSRF token cookie. Defaults to csrf_token.
+func WithCSRFCookie(cookie string) CSRFOption {
+	return func(m *CSRFMiddleware) {
+		m.CSRFCookie = cookie
+	}
+}
+
+// WithCSRFParam sets the name of the CSRF token form parameter. Defaults to csrf_token.
+func WithCSRFParam(param string) CSRFOption {
+	return func(m *CSRFMiddleware) {
+		m.CSRFParam = param
+	}
+}
+
+// WithCSRFErrorStatus sets the status code used when CSRF validation fails. Defaults to 403.
+func WithCSRFErrorStatus(status int) CSRFOption {
+	return func(m *CSRFMiddleware) {
+		m.ErrorStatus = status
+	}
+}
+
+// CSRF returns a middleware that validates the CSRF token of requests against token.
+func CSRF(token string, opts ...CSRFOption) func(http.Handler) http.Handler {
+	template := NewCSRFMiddleware(nil, "X-CSRF-Token", "csrf_token", "csrf_token", token, http.StatusForbidden)
+	for _, opt := range opts {
+		opt(template)
+	}
+
+	return chainable(template, func(m *CSRFMiddleware, next http.Handler) {
+		m.Next = next
+	})
+}
+
 // ServeHTTP is the middleware handler function that provides CSRF protection.
 func (m *CSRFMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.Skipper != nil && m.Skipper(r) {
+		m.Next.ServeHTTP(w, r)
+		return
+	}
+
 	// Retrieve the CSRF token from the request header, cookie, or form parameter.
 	token := r.Header.Get(m.CSRFHeader)
 	if token == "" {
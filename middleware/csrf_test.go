@@ -5,6 +5,7 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/lab42/httplib"
 	"github.com/lab42/httplib/middleware"
 )
 
@@ -52,3 +53,25 @@ func TestCSRFMiddleware(t *testing.T) {
 		t.Errorf("Expected status code %d, but got %d", http.StatusForbidden, rr.Code)
 	}
 }
+
+func TestCSRFMiddlewareSkipper(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// Webhooks are authenticated by signature rather than CSRF token.
+	csrfMiddleware := middleware.NewCSRFMiddleware(handler, "X-CSRF-Token", "csrfCookie", "csrfParam", "abc123", http.StatusForbidden)
+	csrfMiddleware.Skipper = httplib.All(httplib.Method("POST"), httplib.PathPrefix("/webhooks/"))
+
+	rr := httptest.NewRecorder()
+	csrfMiddleware.ServeHTTP(rr, httptest.NewRequest("POST", "/webhooks/github", nil))
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("Expected status code %d, but got %d", http.StatusNoContent, rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	csrfMiddleware.ServeHTTP(rr, httptest.NewRequest("POST", "/orders", nil))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d, but got %d", http.StatusForbidden, rr.Code)
+	}
+}
@@ -2,62 +2,234 @@ package middleware
 
 import (
 	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
+	"github.com/lab42/httplib"
 )
 
 // DatadogMiddleware is a middleware that sends request metrics to Datadog.
 type DatadogMiddleware struct {
 	Next             http.Handler
-	StatsDClient     *statsd.Client
-	StatsDSampleRate float64 // Sample rate for collecting metrics (0.0 - 1.0).
+	Skipper          httplib.Matcher // Skips the middleware for matching requests.
+	StatsDClient     statsd.ClientInterface
+	StatsDSampleRate float64              // Sample rate for collecting metrics (0.0 - 1.0).
+	Tags             []string             // Global tags added to every metric.
+	Route            RouteResolver        // Resolves the route tag. Defaults to DefaultRouteResolver.
+	TagBuilder       DatadogTagBuilder    // Builds additional tags for each request.
+	LatencyMetric    DatadogLatencyMetric // Metric type used to report request latency.
+	Cardinality      *CardinalityLimiter  // Caps the distinct method and route tag values. Unlimited when nil.
+
+	inFlightOnce sync.Once
+	inFlight     *atomic.Int64 // Requests currently being served, shared by the copies made by Datadog.
 }
 
+// DatadogLatencyMetric is the DogStatsD metric type used to report request latency.
+type DatadogLatencyMetric int
+
+const (
+	// DatadogHistogram reports latency in seconds as a histogram aggregated per host.
+	DatadogHistogram DatadogLatencyMetric = iota
+	// DatadogDistribution reports latency in seconds as a distribution aggregated globally.
+	DatadogDistribution
+	// DatadogTiming reports latency in milliseconds as a timing.
+	DatadogTiming
+)
+
+// DatadogTagBuilder returns additional tags for a served request.
+type DatadogTagBuilder func(r *http.Request, status int) []string
+
 // NewDatadogMiddleware creates a new DatadogMiddleware instance.
-func NewDatadogMiddleware(next http.Handler, statsdClient *statsd.Client, sampleRate float64) *DatadogMiddleware {
+func NewDatadogMiddleware(next http.Handler, statsdClient statsd.ClientInterface, sampleRate float64) *DatadogMiddleware {
 	return &DatadogMiddleware{
 		Next:             next,
 		StatsDClient:     statsdClient,
 		StatsDSampleRate: sampleRate,
+		inFlight:         new(atomic.Int64),
 	}
 }
 
+// DatadogOption configures a DatadogMiddleware.
+type DatadogOption func(*DatadogMiddleware)
+
+// WithDatadogSkipper skips the middleware for requests matching skipper.
+func WithDatadogSkipper(skipper httplib.Matcher) DatadogOption {
+	return func(m *DatadogMiddleware) {
+		m.Skipper = skipper
+	}
+}
+
+// WithDatadogSampleRate sets the sample rate for collecting metrics. Defaults to 1.
+func WithDatadogSampleRate(rate float64) DatadogOption {
+	return func(m *DatadogMiddleware) {
+		m.StatsDSampleRate = rate
+	}
+}
+
+// WithDatadogTags adds global tags to every metric.
+func WithDatadogTags(tags ...string) DatadogOption {
+	return func(m *DatadogMiddleware) {
+		m.Tags = append(m.Tags, tags...)
+	}
+}
+
+// WithDatadogRoute sets the resolver of the route tag.
+func WithDatadogRoute(route RouteResolver) DatadogOption {
+	return func(m *DatadogMiddleware) {
+		m.Route = route
+	}
+}
+
+// WithDatadogTagBuilder sets the callback building additional tags for each request.
+func WithDatadogTagBuilder(builder DatadogTagBuilder) DatadogOption {
+	return func(m *DatadogMiddleware) {
+		m.TagBuilder = builder
+	}
+}
+
+// WithDatadogLatencyMetric sets the metric type used to report request latency.
+// Defaults to DatadogHistogram.
+func WithDatadogLatencyMetric(metric DatadogLatencyMetric) DatadogOption {
+	return func(m *DatadogMiddleware) {
+		m.LatencyMetric = metric
+	}
+}
+
+// WithDatadogCardinalityLimiter caps the distinct method and route tag values with limiter.
+func WithDatadogCardinalityLimiter(limiter *CardinalityLimiter) DatadogOption {
+	return func(m *DatadogMiddleware) {
+		m.Cardinality = limiter
+	}
+}
+
+// Datadog returns a middleware that sends request metrics to Datadog through client.
+func Datadog(client statsd.ClientInterface, opts ...DatadogOption) func(http.Handler) http.Handler {
+	template := NewDatadogMiddleware(nil, client, 1)
+	for _, opt := range opts {
+		opt(template)
+	}
+
+	return chainable(template, func(m *DatadogMiddleware, next http.Handler) {
+		m.Next = next
+	})
+}
+
 // ServeHTTP is the middleware handler function that collects and sends request metrics to Datadog.
 func (m *DatadogMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.Skipper != nil && m.Skipper(r) {
+		m.Next.ServeHTTP(w, r)
+		return
+	}
+
+	// The gauge is never sampled, so that it follows every change.
+	m.inFlightOnce.Do(func() {
+		if m.inFlight == nil {
+			m.inFlight = new(atomic.Int64)
+		}
+	})
+	m.StatsDClient.Gauge("http.request.in_flight", float64(m.inFlight.Add(1)), m.Tags, 1)
+	defer func() {
+		m.StatsDClient.Gauge("http.request.in_flight", float64(m.inFlight.Add(-1)), m.Tags, 1)
+	}()
+
 	startTime := time.Now()
+	rw := httplib.NewResponseWriter(w)
 
 	// Call the next handler in the chain.
-	m.Next.ServeHTTP(w, r)
+	m.Next.ServeHTTP(rw, r)
 
 	// Calculate request duration.
 	duration := time.Since(startTime)
 
 	// Send commonly used request metrics to Datadog.
-	m.StatsDClient.Histogram("http.request.duration", float64(duration.Seconds()), []string{}, m.StatsDSampleRate)
-	m.StatsDClient.Incr("http.request.count", []string{}, m.StatsDSampleRate)
-	m.StatsDClient.Incr("http.response.status."+http.StatusText(w.(*datadogResponseWriter).statusCode), []string{}, m.StatsDSampleRate)
+	tags := m.tags(r, rw.Status())
+	m.observeLatency(duration, tags)
+	m.StatsDClient.Incr("http.request.count", tags, m.StatsDSampleRate)
+	if r.ContentLength >= 0 {
+		m.StatsDClient.Histogram("http.request.size", float64(r.ContentLength), tags, m.StatsDSampleRate)
+	}
+	m.StatsDClient.Histogram("http.response.size", float64(rw.BytesWritten()), tags, m.StatsDSampleRate)
+}
+
+// observeLatency reports the request duration using the configured metric type.
+func (m *DatadogMiddleware) observeLatency(duration time.Duration, tags []string) {
+	switch m.LatencyMetric {
+	case DatadogDistribution:
+		m.StatsDClient.Distribution("http.request.duration", duration.Seconds(), tags, m.StatsDSampleRate)
+	case DatadogTiming:
+		m.StatsDClient.Timing("http.request.duration", duration, tags, m.StatsDSampleRate)
+	default:
+		m.StatsDClient.Histogram("http.request.duration", duration.Seconds(), tags, m.StatsDSampleRate)
+	}
+}
+
+// tags returns the tags describing a served request.
+func (m *DatadogMiddleware) tags(r *http.Request, status int) []string {
+	method := r.Method
+	if m.Cardinality != nil {
+		method = m.limit("method", method)
+	}
+
+	tags := make([]string, 0, len(m.Tags)+4)
+	tags = append(tags, m.Tags...)
+	tags = append(tags,
+		"method:"+method,
+		"status:"+strconv.Itoa(status),
+		"status_class:"+statusClass(status),
+	)
+	route := m.route(r)
+	if m.Cardinality != nil {
+		var folded bool
+		if route, folded = m.Cardinality.Route(route, status); folded {
+			m.reportFolded("route")
+		}
+	}
+	tags = append(tags, "route:"+route)
+	if m.TagBuilder != nil {
+		tags = append(tags, m.TagBuilder(r, status)...)
+	}
+	return tags
+}
 
-	// Log the request method as a tag.
-	m.StatsDClient.Incr("http.request.method."+r.Method, []string{}, m.StatsDSampleRate)
+// route resolves the route tag of a served request.
+func (m *DatadogMiddleware) route(r *http.Request) string {
+	resolve := m.Route
+	if resolve == nil {
+		resolve = DefaultRouteResolver
+	}
+	return resolve(r)
+}
 
-	// Log the request path as a tag.
-	m.StatsDClient.Incr("http.request.path."+r.URL.Path, []string{}, m.StatsDSampleRate)
+// limit returns the value reported for tag by the cardinality limiter.
+func (m *DatadogMiddleware) limit(tag, value string) string {
+	value, folded := m.Cardinality.Value(tag, value)
+	if folded {
+		m.reportFolded(tag)
+	}
+	return value
 }
 
-// responseWriter is a custom http.ResponseWriter that tracks response status code.
-type datadogResponseWriter struct {
-	http.ResponseWriter
-	statusCode int
+// reportFolded counts a value of tag folded by the cardinality limiter.
+func (m *DatadogMiddleware) reportFolded(tag string) {
+	tags := append(append(make([]string, 0, len(m.Tags)+1), m.Tags...), "tag:"+tag)
+	m.StatsDClient.Incr("http.metric.tag_values_folded", tags, m.StatsDSampleRate)
 }
 
-// NewResponseWriter creates a new responseWriter instance.
-func NewDatadogResponseWriter(w http.ResponseWriter) *datadogResponseWriter {
-	return &datadogResponseWriter{w, http.StatusOK}
+// statusClass returns the class of an HTTP status code, such as "2xx".
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(status/100) + "xx"
 }
 
-// WriteHeader intercepts the WriteHeader method to track response status code.
-func (rw *datadogResponseWriter) WriteHeader(code int) {
-	rw.statusCode = code
-	rw.ResponseWriter.WriteHeader(code)
+// NewDatadogResponseWriter creates a new response writer tracking the
+// response status code.
+//
+// Deprecated: Use httplib.NewResponseWriter.
+func NewDatadogResponseWriter(w http.ResponseWriter) httplib.ResponseWriter {
+	return httplib.NewResponseWriter(w)
 }
@@ -1 +1,264 @@
 package middleware_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/lab42/httplib/internal"
+	"github.com/lab42/httplib/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+// statsdAgent is a local UDP listener acting as the Datadog agent.
+type statsdAgent struct {
+	conn net.PacketConn
+}
+
+// newStatsdAgent starts a statsdAgent and returns it together with a client sending to it.
+func newStatsdAgent(t *testing.T) (*statsdAgent, *statsd.Client) {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	client, err := statsd.New(conn.LocalAddr().String(), statsd.WithoutTelemetry())
+	if err != nil {
+		t.Fatalf("Failed to create statsd client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return &statsdAgent{conn: conn}, client
+}
+
+// metrics returns the metric lines received until no more packets arrive.
+func (a *statsdAgent) metrics(t *testing.T) []string {
+	t.Helper()
+
+	var lines []string
+	buf := make([]byte, 65536)
+	for {
+		a.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := a.conn.ReadFrom(buf)
+		if err != nil {
+			return lines
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if line != "" {
+				lines = append(lines, line)
+			}
+		}
+	}
+}
+
+// findMetric returns the first line reporting the named metric.
+func findMetric(lines []string, name string) string {
+	for _, line := range lines {
+		if strings.HasPrefix(line, name+":") {
+			return line
+		}
+	}
+	return ""
+}
+
+func TestDatadogMiddleware(t *testing.T) {
+	agent, client := newStatsdAgent(t)
+
+	// Create a handler that does not write its status explicitly.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+
+	// Create a DatadogMiddleware instance.
+	m := middleware.NewDatadogMiddleware(handler, client, 1)
+
+	// Create a test request.
+	req := httptest.NewRequest(http.MethodGet, "/users/123", nil)
+	rr := httptest.NewRecorder()
+
+	// Execute the middleware.
+	m.ServeHTTP(rr, req)
+	client.Flush()
+
+	lines := agent.metrics(t)
+
+	count := findMetric(lines, "http.request.count")
+	if count == "" {
+		t.Fatalf("Expected http.request.count metric, got %q", lines)
+	}
+	for _, tag := range []string{"method:GET", "status:200", "status_class:2xx", "route:/users/:id"} {
+		if !strings.Contains(count, tag) {
+			t.Errorf("Expected tag %q in %q", tag, count)
+		}
+	}
+
+	if findMetric(lines, "http.request.duration") == "" {
+		t.Errorf("Expected http.request.duration metric, got %q", lines)
+	}
+
+	// Check that the raw path is never part of a metric name.
+	for _, line := range lines {
+		if strings.Contains(line, "/users/123") {
+			t.Errorf("Expected raw path not to be reported, got %q", line)
+		}
+	}
+}
+
+func TestDatadogMiddlewareTags(t *testing.T) {
+	agent, client := newStatsdAgent(t)
+
+	// Create a handler returning an error status.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	// Create a Datadog middleware with global tags, a route resolver and a tag builder.
+	m := middleware.Datadog(client,
+		middleware.WithDatadogTags("service:api", "env:test"),
+		middleware.WithDatadogRoute(func(r *http.Request) string { return "/users/{id}" }),
+		middleware.WithDatadogTagBuilder(func(r *http.Request, status int) []string {
+			return []string{"tenant:" + r.Header.Get("X-Tenant")}
+		}),
+	)(handler)
+
+	// Create a test request.
+	req := httptest.NewRequest(http.MethodPost, "/users/123", nil)
+	req.Header.Set("X-Tenant", "acme")
+	rr := httptest.NewRecorder()
+
+	// Execute the middleware.
+	m.ServeHTTP(rr, req)
+	client.Flush()
+
+	count := findMetric(agent.metrics(t), "http.request.count")
+	expected := "|#service:api,env:test,method:POST,status:503,status_class:5xx,route:/users/{id},tenant:acme"
+	if !strings.HasSuffix(count, expected) {
+		t.Errorf("Expected tags %q, got %q", expected, count)
+	}
+}
+
+func TestDatadogMiddlewareLatencyMetric(t *testing.T) {
+	tests := []struct {
+		metric middleware.DatadogLatencyMetric
+		suffix string
+	}{
+		{middleware.DatadogHistogram, "|h"},
+		{middleware.DatadogDistribution, "|d"},
+		{middleware.DatadogTiming, "|ms"},
+	}
+
+	for _, test := range tests {
+		agent, client := newStatsdAgent(t)
+
+		// Create a Datadog middleware reporting latency with the metric type under test.
+		m := middleware.Datadog(client, middleware.WithDatadogLatencyMetric(test.metric))(http.HandlerFunc(internal.DummyHandler))
+
+		// Execute the middleware.
+		m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		client.Flush()
+
+		duration := findMetric(agent.metrics(t), "http.request.duration")
+		if !strings.Contains(duration, test.suffix+"|#") {
+			t.Errorf("Expected latency metric of type %q, got %q", test.suffix, duration)
+		}
+	}
+}
+
+func TestDatadogMiddlewareSizesAndInFlight(t *testing.T) {
+	agent, client := newStatsdAgent(t)
+
+	// Create a handler writing a fixed body.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello, World!"))
+	})
+
+	// Create a Datadog middleware with a global tag.
+	m := middleware.Datadog(client, middleware.WithDatadogTags("service:api"))(handler)
+
+	// Create a test request with a body.
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("payload"))
+	rr := httptest.NewRecorder()
+
+	// Execute the middleware.
+	m.ServeHTTP(rr, req)
+	client.Flush()
+
+	lines := agent.metrics(t)
+
+	if size := findMetric(lines, "http.request.size"); !strings.HasPrefix(size, "http.request.size:7|h") {
+		t.Errorf("Expected request size of 7, got %q", size)
+	}
+	if size := findMetric(lines, "http.response.size"); !strings.HasPrefix(size, "http.response.size:13|h") {
+		t.Errorf("Expected response size of 13, got %q", size)
+	}
+
+	var gauges []string
+	for _, line := range lines {
+		if strings.HasPrefix(line, "http.request.in_flight:") {
+			gauges = append(gauges, line)
+		}
+	}
+	expected := []string{"http.request.in_flight:1|g|#service:api", "http.request.in_flight:0|g|#service:api"}
+	if len(gauges) != len(expected) {
+		t.Fatalf("Expected in-flight gauges %q, got %q", expected, gauges)
+	}
+	for i := range expected {
+		if gauges[i] != expected[i] {
+			t.Errorf("Expected in-flight gauge %q, got %q", expected[i], gauges[i])
+		}
+	}
+}
+
+func TestDatadogMiddlewareInFlightUnsampled(t *testing.T) {
+	agent, client := newStatsdAgent(t)
+
+	// Create a Datadog middleware literal sampling out every other metric.
+	m := &middleware.DatadogMiddleware{
+		Next:             http.HandlerFunc(internal.DummyHandler),
+		StatsDClient:     client,
+		StatsDSampleRate: 0,
+	}
+
+	// Execute the middleware.
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	client.Flush()
+
+	assert.Equal(t, []string{"http.request.in_flight:1|g", "http.request.in_flight:0|g"}, agent.metrics(t))
+}
+
+func TestDatadogMiddlewareCardinalityLimiter(t *testing.T) {
+	agent, client := newStatsdAgent(t)
+
+	// Create a Datadog middleware tagging raw paths, capped to one route.
+	m := middleware.Datadog(client,
+		middleware.WithDatadogRoute(func(r *http.Request) string { return r.URL.Path }),
+		middleware.WithDatadogCardinalityLimiter(middleware.NewCardinalityLimiter(1)),
+	)(http.HandlerFunc(internal.DummyHandler))
+
+	// Perform requests to distinct paths
+	for _, path := range []string{"/a", "/b"} {
+		m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	client.Flush()
+
+	var routes []string
+	var folded string
+	for _, line := range agent.metrics(t) {
+		if strings.HasPrefix(line, "http.request.count:") {
+			routes = append(routes, line[strings.Index(line, "route:"):])
+		}
+		if strings.HasPrefix(line, "http.metric.tag_values_folded:") {
+			folded = line
+		}
+	}
+
+	assert.Equal(t, []string{"route:/a", "route:" + middleware.OtherLabelValue}, routes)
+	assert.Equal(t, "http.metric.tag_values_folded:1|c|#tag:route", folded)
+}
@@ -1,15 +1,20 @@
 package middleware
 
 import (
+	"bufio"
 	"compress/gzip"
+	"net"
 	"net/http"
 	"strings"
+
+	"github.com/lab42/httplib"
 )
 
 // GzipMiddleware is a middleware that compresses response data using gzip.
 type GzipMiddleware struct {
 	Next             http.Handler
-	CompressionLevel *int // Compression level (0-9), where 0 is no compression, and 9 is maximum compression.
+	Skipper          httplib.Matcher // Skips the middleware for matching requests.
+	CompressionLevel *int            // Compression level (0-9), where 0 is no compression, and 9 is maximum compression.
 }
 
 // NewGzipMiddleware creates a new GzipMiddleware instance with the specified compression level.
@@ -21,10 +26,45 @@ func NewGzipMiddleware(next http.Handler, compressionLevel *int) *GzipMiddleware
 	}
 }
 
+// GzipOption configures a GzipMiddleware.
+type GzipOption func(*GzipMiddleware)
+
+// WithGzipSkipper skips the middleware for requests matching skipper.
+func WithGzipSkipper(skipper httplib.Matcher) GzipOption {
+	return func(m *GzipMiddleware) {
+		m.Skipper = skipper
+	}
+}
+
+// WithGzipLevel sets the compression level (0-9). Defaults to gzip.DefaultCompression.
+func WithGzipLevel(level int) GzipOption {
+	return func(m *GzipMiddleware) {
+		m.CompressionLevel = &level
+	}
+}
+
+// Gzip returns a middleware that compresses response data using gzip.
+func Gzip(opts ...GzipOption) func(http.Handler) http.Handler {
+	template := NewGzipMiddleware(nil, nil)
+	for _, opt := range opts {
+		opt(template)
+	}
+
+	return chainable(template, func(m *GzipMiddleware, next http.Handler) {
+		m.Next = next
+	})
+}
+
 // ServeHTTP is the middleware handler function that performs gzip compression.
 func (m *GzipMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Check if the client supports gzip encoding.
-	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+	if m.Skipper != nil && m.Skipper(r) {
+		m.Next.ServeHTTP(w, r)
+		return
+	}
+
+	// Check if the client supports gzip encoding. Protocol upgrades such as
+	// WebSocket handshakes are passed along as-is.
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") && r.Header.Get("Upgrade") == "" {
 		var compressionLevel int
 		if m.CompressionLevel != nil {
 			compressionLevel = *m.CompressionLevel
@@ -45,7 +85,7 @@ func (m *GzipMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Encoding", "gzip")
 
 		// Wrap the response writer with the gzip writer.
-		m.Next.ServeHTTP(NewGzipResponseWriter(w, gz), r)
+		m.Next.ServeHTTP(wrapGzipResponseWriter(NewGzipResponseWriter(w, gz)), r)
 	} else {
 		// If the client does not support gzip, pass the request along as-is.
 		m.Next.ServeHTTP(w, r)
@@ -53,6 +93,8 @@ func (m *GzipMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 // GzipResponseWriter is a custom response writer that wraps a gzip writer.
+// The GzipMiddleware exposes http.Flusher, http.Hijacker and http.Pusher on
+// it only when the wrapped writer implements them.
 type GzipResponseWriter struct {
 	http.ResponseWriter
 	gz *gzip.Writer
@@ -70,3 +112,49 @@ func NewGzipResponseWriter(w http.ResponseWriter, gz *gzip.Writer) *GzipResponse
 func (grw *GzipResponseWriter) Write(b []byte) (int, error) {
 	return grw.gz.Write(b)
 }
+
+// Unwrap returns the wrapped response writer, for use by http.ResponseController.
+func (grw *GzipResponseWriter) Unwrap() http.ResponseWriter {
+	return grw.ResponseWriter
+}
+
+// wrapGzipResponseWriter returns grw implementing the optional interfaces of
+// the writer it wraps, except io.ReaderFrom, which would bypass compression.
+func wrapGzipResponseWriter(grw *GzipResponseWriter) http.ResponseWriter {
+	return httplib.WithOptionalInterfaces(httplib.NewResponseWriter(grw), grw.ResponseWriter, httplib.OptionalInterfaces{
+		Flusher:  gzipFlusher{grw},
+		Hijacker: gzipHijacker{grw},
+		Pusher:   gzipPusher{grw},
+	})
+}
+
+// gzipFlusher implements http.Flusher for a GzipResponseWriter.
+type gzipFlusher struct {
+	*GzipResponseWriter
+}
+
+// Flush flushes the compressed data buffered by the gzip writer, then the
+// wrapped response writer.
+func (f gzipFlusher) Flush() {
+	f.gz.Flush()
+	f.ResponseWriter.(http.Flusher).Flush()
+}
+
+// gzipHijacker implements http.Hijacker for a GzipResponseWriter.
+type gzipHijacker struct {
+	*GzipResponseWriter
+}
+
+// Hijack lets the caller take over the connection of the wrapped response writer.
+func (h gzipHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return h.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+// gzipPusher implements http.Pusher for a GzipResponseWriter.
+type gzipPusher struct {
+	*GzipResponseWriter
+}
+
+func (p gzipPusher) Push(target string, opts *http.PushOptions) error {
+	return p.ResponseWriter.(http.Pusher).Push(target, opts)
+}
@@ -7,6 +7,7 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/lab42/httplib"
 	"github.com/lab42/httplib/middleware"
 )
 
@@ -82,3 +83,66 @@ func TestGzipResponseWriter_Write(t *testing.T) {
 		t.Error("Expected data to be written to the response writer, but got an empty response")
 	}
 }
+
+func TestGzipMiddlewareSkipper(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("metrics"))
+	})
+
+	// Skip compression for the metrics endpoint.
+	middleware := middleware.Gzip(middleware.WithGzipSkipper(httplib.PathPrefix("/metrics")))(handler)
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, req)
+
+	if rr.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Expected no Content-Encoding, but got '%s'", rr.Header().Get("Content-Encoding"))
+	}
+	if rr.Body.String() != "metrics" {
+		t.Errorf("Expected response 'metrics', but got '%s'", rr.Body.String())
+	}
+}
+
+func TestGzipResponseWriter_Flush(t *testing.T) {
+	rr := httptest.NewRecorder()
+
+	// Create a handler flushing the data written so far.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data: event\n\n"))
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			t.Fatalf("Unexpected error flushing: %v", err)
+		}
+
+		// Flushing streams the compressed data written so far.
+		if !rr.Flushed || rr.Body.Len() <= 10 {
+			t.Error("Expected compressed data to be flushed to the response writer")
+		}
+	})
+
+	// Create a test request accepting gzip.
+	req := httptest.NewRequest(http.MethodGet, "/events", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	middleware.Gzip()(handler).ServeHTTP(rr, req)
+}
+
+func TestGzipResponseWriter_OptionalInterfaces(t *testing.T) {
+	// Create a handler checking the interfaces of its response writer.
+	var isFlusher, isHijacker bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, isFlusher = w.(http.Flusher)
+		_, isHijacker = w.(http.Hijacker)
+	})
+
+	// Create a test request accepting gzip.
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	// httptest.ResponseRecorder only implements http.Flusher.
+	middleware.Gzip()(handler).ServeHTTP(httptest.NewRecorder(), req)
+	if !isFlusher || isHijacker {
+		t.Errorf("Expected a flusher only, but got flusher %t and hijacker %t", isFlusher, isHijacker)
+	}
+}
@@ -0,0 +1,178 @@
+package middleware
+
+import (
+	"bufio"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// LogFile is a buffered log file that can be reopened, so that it plays
+// along with external log rotation: after the file has been moved aside,
+// Reopen, or a SIGHUP when ReopenOnSignal is used, starts a new file at the
+// same path. Writes are safe for concurrent use.
+type LogFile struct {
+	path          string
+	flushInterval time.Duration
+
+	mu      sync.Mutex
+	file    *os.File
+	buf     *bufio.Writer
+	onError func(error)
+	signals chan os.Signal
+	done    chan struct{}
+	closed  bool
+}
+
+// OpenLogFile opens the log file at path in append mode, creating it if
+// needed. Writes stay buffered for at most flushInterval, one second when
+// zero.
+func OpenLogFile(path string, flushInterval time.Duration) (*LogFile, error) {
+	if flushInterval <= 0 {
+		flushInterval = time.Second
+	}
+	file, err := openLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &LogFile{
+		path:          path,
+		flushInterval: flushInterval,
+		file:          file,
+		buf:           bufio.NewWriter(file),
+		done:          make(chan struct{}),
+	}
+	go f.flushLoop()
+	return f, nil
+}
+
+func openLogFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+}
+
+// OnError sets the handler of the errors of the periodic flushes and of the
+// reopens on signal, which have no caller to return them to. They are
+// dropped when no handler is set.
+func (f *LogFile) OnError(handler func(error)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.onError = handler
+}
+
+// reportError passes err to the error handler, if any.
+func (f *LogFile) reportError(err error) {
+	f.mu.Lock()
+	handler := f.onError
+	f.mu.Unlock()
+	if err != nil && handler != nil {
+		handler(err)
+	}
+}
+
+// Write writes p to the buffer of the log file.
+func (f *LogFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	return f.buf.Write(p)
+}
+
+// Flush writes the buffered data to the log file.
+func (f *LogFile) Flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	return f.buf.Flush()
+}
+
+// Reopen opens the file at the path of the log file again, then flushes and
+// closes the previous file. When the file cannot be opened, the previous one
+// is kept and written to.
+func (f *LogFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+
+	file, err := openLogFile(f.path)
+	if err != nil {
+		return err
+	}
+	err = f.buf.Flush()
+	if cerr := f.file.Close(); err == nil {
+		err = cerr
+	}
+	f.file = file
+	f.buf = bufio.NewWriter(file)
+	return err
+}
+
+// ReopenOnSignal reopens the log file whenever the process receives one of
+// sigs, SIGHUP when none is given, until the log file is closed. Reopen
+// errors are passed to the OnError handler.
+func (f *LogFile) ReopenOnSignal(sigs ...os.Signal) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGHUP}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed || f.signals != nil {
+		return
+	}
+	f.signals = make(chan os.Signal, 1)
+	signal.Notify(f.signals, sigs...)
+
+	go func() {
+		for {
+			select {
+			case <-f.signals:
+				f.reportError(f.Reopen())
+			case <-f.done:
+				return
+			}
+		}
+	}()
+}
+
+// flushLoop flushes the log file periodically until it is closed.
+func (f *LogFile) flushLoop() {
+	ticker := time.NewTicker(f.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			f.reportError(f.Flush())
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// Close flushes and closes the log file and stops its goroutines.
+func (f *LogFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	close(f.done)
+	if f.signals != nil {
+		signal.Stop(f.signals)
+	}
+
+	err := f.buf.Flush()
+	if cerr := f.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
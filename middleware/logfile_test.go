@@ -0,0 +1,106 @@
+package middleware_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lab42/httplib/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	f, err := middleware.OpenLogFile(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to open log file: %v", err)
+	}
+
+	// Writes are buffered until flushed.
+	f.Write([]byte("first\n"))
+	content, _ := os.ReadFile(path)
+	assert.Equal(t, "", string(content))
+
+	assert.NoError(t, f.Flush())
+	content, _ = os.ReadFile(path)
+	assert.Equal(t, "first\n", string(content))
+
+	// Closing flushes the remaining writes.
+	f.Write([]byte("second\n"))
+	assert.NoError(t, f.Close())
+	content, _ = os.ReadFile(path)
+	assert.Equal(t, "first\nsecond\n", string(content))
+
+	_, err = f.Write([]byte("third\n"))
+	assert.ErrorIs(t, err, os.ErrClosed)
+}
+
+func TestLogFileFlushInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	f, err := middleware.OpenLogFile(path, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Failed to open log file: %v", err)
+	}
+	defer f.Close()
+
+	f.Write([]byte("line\n"))
+	assert.Eventually(t, func() bool {
+		content, _ := os.ReadFile(path)
+		return string(content) == "line\n"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestLogFileReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+
+	f, err := middleware.OpenLogFile(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to open log file: %v", err)
+	}
+	defer f.Close()
+
+	// Rotate the file, then reopen it.
+	f.Write([]byte("before\n"))
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatalf("Failed to rotate log file: %v", err)
+	}
+	assert.NoError(t, f.Reopen())
+	f.Write([]byte("after\n"))
+	f.Flush()
+
+	rotated, _ := os.ReadFile(path + ".1")
+	assert.Equal(t, "before\n", string(rotated))
+	current, _ := os.ReadFile(path)
+	assert.Equal(t, "after\n", string(current))
+}
+
+func TestLogFileReopenFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	f, err := middleware.OpenLogFile(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to open log file: %v", err)
+	}
+
+	// Rotate the file and put a directory in its place.
+	f.Write([]byte("before\n"))
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatalf("Failed to rotate log file: %v", err)
+	}
+	if err := os.Mkdir(path, 0o755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	// The failed reopen keeps the previous file.
+	assert.Error(t, f.Reopen())
+	f.Write([]byte("after\n"))
+	assert.NoError(t, f.Flush())
+	assert.NoError(t, f.Close())
+
+	rotated, _ := os.ReadFile(path + ".1")
+	assert.Equal(t, "before\nafter\n", string(rotated))
+}
@@ -0,0 +1,76 @@
+//go:build unix
+
+package middleware_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lab42/httplib/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogFileReopenOnSignal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	f, err := middleware.OpenLogFile(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to open log file: %v", err)
+	}
+	defer f.Close()
+	f.ReopenOnSignal()
+
+	// Rotate the file, then signal the process.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatalf("Failed to rotate log file: %v", err)
+	}
+	process, _ := os.FindProcess(os.Getpid())
+	if err := process.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf("Failed to signal process: %v", err)
+	}
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestLogFileReopenOnSignalError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	f, err := middleware.OpenLogFile(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to open log file: %v", err)
+	}
+	defer f.Close()
+
+	errs := make(chan error, 1)
+	f.OnError(func(err error) {
+		errs <- err
+	})
+	f.ReopenOnSignal()
+
+	// Replace the file by a directory, then signal the process.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatalf("Failed to rotate log file: %v", err)
+	}
+	if err := os.Mkdir(path, 0o755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	process, _ := os.FindProcess(os.Getpid())
+	if err := process.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf("Failed to signal process: %v", err)
+	}
+
+	select {
+	case err := <-errs:
+		var pathErr *os.PathError
+		assert.True(t, errors.As(err, &pathErr), err)
+	case <-time.After(time.Second):
+		t.Fatal("Expected the reopen error to be reported")
+	}
+}
@@ -2,184 +2,366 @@ package middleware
 
 import (
 	"net/http"
-	"strconv"
+	"time"
+	"unicode/utf8"
 
-	"github.com/gorilla/mux"
+	"github.com/lab42/httplib"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// PrometheusMiddleware is a middleware that collects Prometheus metrics for HTTP requests.
+// PrometheusMiddleware is a middleware that collects Prometheus RED (rate,
+// errors, duration) metrics for HTTP requests.
 type PrometheusMiddleware struct {
-	Next                        http.Handler
-	TotalRequests               *prometheus.CounterVec
-	ResponseStatus              *prometheus.CounterVec
-	HttpDuration                *prometheus.HistogramVec
-	RequestMethods              *prometheus.CounterVec
-	RequestSize                 *prometheus.HistogramVec
-	ResponseSize                *prometheus.HistogramVec
-	HttpDurationByMethod        *prometheus.HistogramVec
-	HttpResponseTimePercentiles *prometheus.SummaryVec
-}
-
-// NewPrometheusMiddleware creates a new PrometheusMiddleware instance.
-func NewPrometheusMiddleware(next http.Handler) *PrometheusMiddleware {
-	// Create Prometheus metrics
-	totalRequests := prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "http_requests_total",
-			Help: "Number of requests",
-		},
-		[]string{"path"},
-	)
+	Next                    http.Handler
+	Skipper                 httplib.Matcher          // Skips the middleware for matching requests.
+	Route                   RouteResolver            // Resolves the route label. Defaults to DefaultRouteResolver.
+	TraceID                 TraceIDExtractor         // Extracts the trace ID of exemplars. Defaults to TraceParentID.
+	Cardinality             *CardinalityLimiter      // Caps the distinct method and route label values. Unlimited when nil.
+	RequestDuration         *prometheus.HistogramVec // Request duration by method, route and status class.
+	RequestsInFlight        prometheus.Gauge         // Requests currently being served.
+	TimeToFirstByte         *prometheus.HistogramVec // Time to the first response byte by method and route.
+	RequestSize             *prometheus.HistogramVec // Request body size by method and route.
+	ResponseSize            *prometheus.HistogramVec // Response body size by method and route.
+	ResponseTimePercentiles *prometheus.SummaryVec   // Request duration quantiles by method and route, nil unless objectives are configured.
 
-	responseStatus := prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "response_status",
-			Help: "Status of HTTP response",
-		},
-		[]string{"status"},
-	)
+	config prometheusConfig // Settings the metrics are created with.
+}
 
-	httpDuration := promauto.NewHistogramVec(prometheus.HistogramOpts{
-		Name: "http_response_time_seconds",
-		Help: "Duration of HTTP requests",
-	}, []string{"path"})
+// prometheusConfig holds the settings PrometheusMiddleware metrics are created with.
+type prometheusConfig struct {
+	registerer         prometheus.Registerer
+	namespace          string
+	subsystem          string
+	constLabels        prometheus.Labels
+	buckets            []float64
+	sizeBuckets        []float64
+	objectives         map[float64]float64
+	nativeBucketFactor float64
+}
 
-	requestMethods := prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "http_request_methods_total",
-			Help: "Number of requests by HTTP method",
+// NewPrometheusMiddleware creates a new PrometheusMiddleware instance. The
+// metrics are registered with the default registerer unless configured
+// otherwise; metrics that are already registered are reused.
+func NewPrometheusMiddleware(next http.Handler, opts ...PrometheusOption) *PrometheusMiddleware {
+	prometheusMiddleware := &PrometheusMiddleware{
+		Next: next,
+		config: prometheusConfig{
+			registerer:  prometheus.DefaultRegisterer,
+			buckets:     prometheus.DefBuckets,
+			sizeBuckets: prometheus.ExponentialBuckets(100, 10, 6),
 		},
-		[]string{"method"},
-	)
+	}
+	for _, opt := range opts {
+		opt(prometheusMiddleware)
+	}
+	c := prometheusMiddleware.config
+
+	// Create Prometheus metrics
+	requestDuration := prometheus.NewHistogramVec(c.durationOpts(
+		"http_request_duration_seconds",
+		"Duration of HTTP requests",
+	), []string{"method", "route", "status_class"})
+
+	requestsInFlight := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   c.namespace,
+		Subsystem:   c.subsystem,
+		Name:        "http_requests_in_flight",
+		Help:        "Number of HTTP requests being served",
+		ConstLabels: c.constLabels,
+	})
+
+	timeToFirstByte := prometheus.NewHistogramVec(c.durationOpts(
+		"http_time_to_first_byte_seconds",
+		"Time until the first byte of HTTP responses is written",
+	), []string{"method", "route"})
 
 	requestSize := prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
-			Name: "http_request_size_bytes",
-			Help: "Size of incoming HTTP requests",
+			Namespace:   c.namespace,
+			Subsystem:   c.subsystem,
+			Name:        "http_request_size_bytes",
+			Help:        "Size of incoming HTTP requests",
+			ConstLabels: c.constLabels,
+			Buckets:     c.sizeBuckets,
 		},
-		[]string{"path"},
+		[]string{"method", "route"},
 	)
 
 	responseSize := prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
-			Name: "http_response_size_bytes",
-			Help: "Size of HTTP responses",
+			Namespace:   c.namespace,
+			Subsystem:   c.subsystem,
+			Name:        "http_response_size_bytes",
+			Help:        "Size of HTTP responses",
+			ConstLabels: c.constLabels,
+			Buckets:     c.sizeBuckets,
 		},
-		[]string{"path"},
+		[]string{"method", "route"},
 	)
 
-	httpDurationByMethod := promauto.NewHistogramVec(prometheus.HistogramOpts{
-		Name: "http_response_time_seconds_by_method",
-		Help: "Duration of HTTP requests by method",
-	}, []string{"method"})
-
-	httpResponseTimePercentiles := promauto.NewSummaryVec(prometheus.SummaryOpts{
-		Name:       "http_response_time_percentiles",
-		Help:       "Response time percentiles",
-		Objectives: map[float64]float64{0.5: 0.05, 0.95: 0.01, 0.99: 0.001},
-	}, []string{"path"})
+	// Register Prometheus metrics
+	prometheusMiddleware.RequestDuration = registerCollector(c.registerer, requestDuration)
+	prometheusMiddleware.RequestsInFlight = registerCollector(c.registerer, requestsInFlight)
+	prometheusMiddleware.TimeToFirstByte = registerCollector(c.registerer, timeToFirstByte)
+	prometheusMiddleware.RequestSize = registerCollector(c.registerer, requestSize)
+	prometheusMiddleware.ResponseSize = registerCollector(c.registerer, responseSize)
 
-	// Create PrometheusMiddleware instance
-	prometheusMiddleware := &PrometheusMiddleware{
-		Next:                        next,
-		TotalRequests:               totalRequests,
-		ResponseStatus:              responseStatus,
-		HttpDuration:                httpDuration,
-		RequestMethods:              requestMethods,
-		RequestSize:                 requestSize,
-		ResponseSize:                responseSize,
-		HttpDurationByMethod:        httpDurationByMethod,
-		HttpResponseTimePercentiles: httpResponseTimePercentiles,
+	if prometheusMiddleware.Cardinality != nil {
+		registerCollector(c.registerer, prometheusMiddleware.Cardinality)
 	}
 
-	// Register Prometheus metrics
-	prometheus.MustRegister(
-		prometheusMiddleware.TotalRequests,
-		prometheusMiddleware.ResponseStatus,
-		prometheusMiddleware.HttpDuration,
-		prometheusMiddleware.RequestMethods,
-		prometheusMiddleware.RequestSize,
-		prometheusMiddleware.ResponseSize,
-		prometheusMiddleware.HttpDurationByMethod,
-		prometheusMiddleware.HttpResponseTimePercentiles,
-	)
+	if c.objectives != nil {
+		responseTimePercentiles := prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Namespace:   c.namespace,
+			Subsystem:   c.subsystem,
+			Name:        "http_request_duration_quantiles_seconds",
+			Help:        "Quantiles of the duration of HTTP requests",
+			ConstLabels: c.constLabels,
+			Objectives:  c.objectives,
+		}, []string{"method", "route"})
+		prometheusMiddleware.ResponseTimePercentiles = registerCollector(c.registerer, responseTimePercentiles)
+	}
 
 	return prometheusMiddleware
 }
 
+// durationOpts returns the options of a duration histogram, using native
+// histograms alongside the classic buckets when enabled.
+func (c prometheusConfig) durationOpts(name, help string) prometheus.HistogramOpts {
+	opts := prometheus.HistogramOpts{
+		Namespace:   c.namespace,
+		Subsystem:   c.subsystem,
+		Name:        name,
+		Help:        help,
+		ConstLabels: c.constLabels,
+		Buckets:     c.buckets,
+	}
+	if c.nativeBucketFactor > 1 {
+		opts.NativeHistogramBucketFactor = c.nativeBucketFactor
+		opts.NativeHistogramMaxBucketNumber = 160
+		opts.NativeHistogramMinResetDuration = time.Hour
+	}
+	return opts
+}
+
+// registerCollector registers c with registerer and returns it. When an
+// identical collector is already registered, the existing one is returned
+// instead. Any other registration error panics.
+func registerCollector[C prometheus.Collector](registerer prometheus.Registerer, c C) C {
+	if registerer == nil {
+		return c
+	}
+	if err := registerer.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			if existing, ok := are.ExistingCollector.(C); ok {
+				return existing
+			}
+		}
+		panic(err)
+	}
+	return c
+}
+
+// PrometheusOption configures a PrometheusMiddleware.
+type PrometheusOption func(*PrometheusMiddleware)
+
+// WithPrometheusSkipper skips the middleware for requests matching skipper.
+func WithPrometheusSkipper(skipper httplib.Matcher) PrometheusOption {
+	return func(m *PrometheusMiddleware) {
+		m.Skipper = skipper
+	}
+}
+
+// WithPrometheusRouteResolver sets the resolver of the route label.
+func WithPrometheusRouteResolver(resolver RouteResolver) PrometheusOption {
+	return func(m *PrometheusMiddleware) {
+		m.Route = resolver
+	}
+}
+
+// WithPrometheusTraceID sets the extractor of the trace ID attached to
+// duration observations as an exemplar.
+func WithPrometheusTraceID(extractor TraceIDExtractor) PrometheusOption {
+	return func(m *PrometheusMiddleware) {
+		m.TraceID = extractor
+	}
+}
+
+// WithPrometheusCardinalityLimiter caps the distinct method and route label
+// values with limiter, which is registered alongside the metrics.
+func WithPrometheusCardinalityLimiter(limiter *CardinalityLimiter) PrometheusOption {
+	return func(m *PrometheusMiddleware) {
+		m.Cardinality = limiter
+	}
+}
+
+// WithPrometheusRegisterer registers the metrics with registerer instead of
+// prometheus.DefaultRegisterer. A nil registerer leaves the metrics unregistered.
+func WithPrometheusRegisterer(registerer prometheus.Registerer) PrometheusOption {
+	return func(m *PrometheusMiddleware) {
+		m.config.registerer = registerer
+	}
+}
+
+// WithPrometheusNamespace sets the namespace and subsystem prefixed to every metric name.
+func WithPrometheusNamespace(namespace, subsystem string) PrometheusOption {
+	return func(m *PrometheusMiddleware) {
+		m.config.namespace = namespace
+		m.config.subsystem = subsystem
+	}
+}
+
+// WithPrometheusConstLabels adds constant labels, such as the service name or
+// version, to every metric.
+func WithPrometheusConstLabels(labels prometheus.Labels) PrometheusOption {
+	return func(m *PrometheusMiddleware) {
+		m.config.constLabels = labels
+	}
+}
+
+// WithPrometheusBuckets sets the buckets of the duration histograms. Defaults
+// to prometheus.DefBuckets.
+func WithPrometheusBuckets(buckets []float64) PrometheusOption {
+	return func(m *PrometheusMiddleware) {
+		m.config.buckets = buckets
+	}
+}
+
+// WithPrometheusSizeBuckets sets the buckets of the request and response size
+// histograms. Defaults to exponential buckets from 100 bytes to 10 megabytes.
+func WithPrometheusSizeBuckets(buckets []float64) PrometheusOption {
+	return func(m *PrometheusMiddleware) {
+		m.config.sizeBuckets = buckets
+	}
+}
+
+// WithPrometheusObjectives enables a summary of the request duration with the
+// given quantile objectives, such as {0.5: 0.05, 0.99: 0.001}.
+func WithPrometheusObjectives(objectives map[float64]float64) PrometheusOption {
+	return func(m *PrometheusMiddleware) {
+		m.config.objectives = objectives
+	}
+}
+
+// WithPrometheusNativeHistograms additionally exposes the duration histograms
+// as native histograms, with the given growth factor between buckets, such as
+// 1.1. Native histograms are only scraped by servers supporting them.
+func WithPrometheusNativeHistograms(bucketFactor float64) PrometheusOption {
+	return func(m *PrometheusMiddleware) {
+		m.config.nativeBucketFactor = bucketFactor
+	}
+}
+
+// Prometheus returns a middleware that collects Prometheus metrics for HTTP
+// requests. The metrics are registered once and shared by all the handlers
+// the middleware wraps.
+func Prometheus(opts ...PrometheusOption) func(http.Handler) http.Handler {
+	template := NewPrometheusMiddleware(nil, opts...)
+
+	return chainable(template, func(m *PrometheusMiddleware, next http.Handler) {
+		m.Next = next
+	})
+}
+
 // ServeHTTP is the middleware handler function that collects Prometheus metrics.
 func (m *PrometheusMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Get the current route's path
-	route := mux.CurrentRoute(r)
-	path, _ := route.GetPathTemplate()
+	if m.Skipper != nil && m.Skipper(r) {
+		m.Next.ServeHTTP(w, r)
+		return
+	}
+
+	m.RequestsInFlight.Inc()
+	defer m.RequestsInFlight.Dec()
 
 	// Start measuring response time
-	timer := prometheus.NewTimer(m.HttpDuration.WithLabelValues(path))
+	start := time.Now()
 
-	// Create a custom response writer to track response size
-	customRW := NewPrometheusResponseWriter(w)
+	// Create a custom response writer to track the response
+	customRW := httplib.NewResponseWriter(w)
 
 	// Call the next handler in the chain
 	m.Next.ServeHTTP(customRW, r)
 
-	// Get the response status code
-	statusCode := customRW.statusCode
+	duration := time.Since(start)
 
-	// Increment response status counter
-	m.ResponseStatus.WithLabelValues(strconv.Itoa(statusCode)).Inc()
-
-	// Increment total requests counter for the specific path
-	m.TotalRequests.WithLabelValues(path).Inc()
+	// The route is only known once the router has matched the request
+	method, route := r.Method, m.route(r)
+	if m.Cardinality != nil {
+		method, _ = m.Cardinality.Value("method", method)
+		route, _ = m.Cardinality.Route(route, customRW.Status())
+	}
+	class := statusClass(customRW.Status())
 
-	// Increment request methods counter for the HTTP method used
-	m.RequestMethods.WithLabelValues(r.Method).Inc()
+	traceID := m.traceID(r)
+	observe(m.RequestDuration.WithLabelValues(method, route, class), duration.Seconds(), traceID)
+	if m.ResponseTimePercentiles != nil {
+		m.ResponseTimePercentiles.WithLabelValues(method, route).Observe(duration.Seconds())
+	}
+	if customRW.BytesWritten() > 0 {
+		observe(m.TimeToFirstByte.WithLabelValues(method, route), customRW.TimeToFirstByte().Seconds(), traceID)
+	}
 
 	// Calculate request size
 	requestSize := r.ContentLength
 	if requestSize < 0 {
 		requestSize = 0
 	}
-	m.RequestSize.WithLabelValues(path).Observe(float64(requestSize))
-
-	// Calculate response size
-	responseSize := customRW.Size()
-	m.ResponseSize.WithLabelValues(path).Observe(float64(responseSize))
-
-	// Calculate response time by HTTP method
-	m.HttpDurationByMethod.WithLabelValues(r.Method).Observe(timer.ObserveDuration().Seconds())
+	m.RequestSize.WithLabelValues(method, route).Observe(float64(requestSize))
+	m.ResponseSize.WithLabelValues(method, route).Observe(float64(customRW.BytesWritten()))
+}
 
-	// Calculate response time percentiles
-	m.HttpResponseTimePercentiles.WithLabelValues(path).Observe(timer.ObserveDuration().Seconds())
+// traceID extracts the trace ID attached to observations as an exemplar.
+func (m *PrometheusMiddleware) traceID(r *http.Request) string {
+	extract := m.TraceID
+	if extract == nil {
+		extract = TraceParentID
+	}
+	return extract(r)
 }
 
-// responseWriter is a custom http.ResponseWriter that tracks response status code.
-type prometheusResponseWriter struct {
-	http.ResponseWriter
-	statusCode int
-	size       int64
+// observe records v in observer, with an exemplar linking to the trace when
+// traceID is a valid exemplar label value. Invalid values, such as overlong
+// client supplied IDs, would make the observer panic.
+func observe(observer prometheus.Observer, v float64, traceID string) {
+	if eo, ok := observer.(prometheus.ExemplarObserver); ok && validExemplarTraceID(traceID) {
+		eo.ObserveWithExemplar(v, prometheus.Labels{"trace_id": traceID})
+		return
+	}
+	observer.Observe(v)
 }
 
-// NewResponseWriter creates a new responseWriter instance.
-func NewPrometheusResponseWriter(w http.ResponseWriter) *prometheusResponseWriter {
-	return &prometheusResponseWriter{w, http.StatusOK, 0}
+// validExemplarTraceID reports whether traceID fits in the labels of an exemplar.
+func validExemplarTraceID(traceID string) bool {
+	return traceID != "" && utf8.ValidString(traceID) &&
+		utf8.RuneCountInString("trace_id")+utf8.RuneCountInString(traceID) <= prometheus.ExemplarMaxRunes
 }
 
-// WriteHeader intercepts the WriteHeader method to track response status code.
-func (rw *prometheusResponseWriter) WriteHeader(code int) {
-	rw.statusCode = code
-	rw.ResponseWriter.WriteHeader(code)
+// PrometheusHandler returns a handler serving the metrics gathered by
+// gatherer, or prometheus.DefaultGatherer when nil, in the OpenMetrics format
+// when the scraper accepts it so exemplars are exposed.
+func PrometheusHandler(gatherer prometheus.Gatherer) http.Handler {
+	if gatherer == nil {
+		gatherer = prometheus.DefaultGatherer
+	}
+	return promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	})
 }
 
-// Write intercepts the Write method to track response size.
-func (rw *prometheusResponseWriter) Write(b []byte) (int, error) {
-	size, err := rw.ResponseWriter.Write(b)
-	rw.size += int64(size)
-	return size, err
+// route resolves the route label of a served request.
+func (m *PrometheusMiddleware) route(r *http.Request) string {
+	resolve := m.Route
+	if resolve == nil {
+		resolve = DefaultRouteResolver
+	}
+	return resolve(r)
 }
 
-// Size returns the accumulated response size.
-func (rw *prometheusResponseWriter) Size() int64 {
-	return rw.size
+// NewPrometheusResponseWriter creates a new response writer tracking the
+// response status code and size.
+//
+// Deprecated: Use httplib.NewResponseWriter.
+func NewPrometheusResponseWriter(w http.ResponseWriter) httplib.ResponseWriter {
+	return httplib.NewResponseWriter(w)
 }
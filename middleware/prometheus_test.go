@@ -3,128 +3,320 @@ package middleware_test
 import (
 	"net/http"
 	"net/http/httptest"
-	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/lab42/httplib/internal"
 	"github.com/lab42/httplib/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 )
 
-func TestPrometheusMiddleware(t *testing.T) {
-	// Create a router with PrometheusMiddleware
+// newPrometheusRouter returns a router serving handler on /test behind a
+// PrometheusMiddleware created with opts.
+func newPrometheusRouter(handler http.Handler, opts ...middleware.PrometheusOption) (*mux.Router, *middleware.PrometheusMiddleware) {
+	m := middleware.NewPrometheusMiddleware(handler, opts...)
 	r := mux.NewRouter()
-	prometheusMiddleware := middleware.NewPrometheusMiddleware(internal.DummyHandler())
-	r.Use(middleware.NewPrometheusMiddleware())
+	r.Handle("/test", m)
+	return r, m
+}
+
+func TestPrometheusMiddleware(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	// Create a handler returning a fixed body and status.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not Found"))
+	})
+	r, m := newPrometheusRouter(handler,
+		middleware.WithPrometheusRegisterer(reg),
+		middleware.WithPrometheusSizeBuckets([]float64{1, 10}),
+	)
 
 	// Create a test request
-	req, _ := http.NewRequest("GET", "/test", nil)
+	req := httptest.NewRequest(http.MethodPost, "/test", strings.NewReader("payload"))
 	res := httptest.NewRecorder()
 
 	// Perform the request
 	r.ServeHTTP(res, req)
 
-	// Assert the response status code is 200 OK
-	assert.Equal(t, http.StatusOK, res.Code)
+	// Assert the response status code is passed through
+	assert.Equal(t, http.StatusNotFound, res.Code)
 
 	// Assert Prometheus metrics were recorded as expected
-	assertPrometheusMetrics(t, prometheusMiddleware)
+	assert.Equal(t, 1, testutil.CollectAndCount(m.RequestDuration))
+	assert.Equal(t, 1, testutil.CollectAndCount(m.TimeToFirstByte))
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.RequestsInFlight))
+	assert.Nil(t, m.ResponseTimePercentiles)
+
+	expected := `
+# HELP http_request_size_bytes Size of incoming HTTP requests
+# TYPE http_request_size_bytes histogram
+http_request_size_bytes_bucket{method="POST",route="/test",le="1"} 0
+http_request_size_bytes_bucket{method="POST",route="/test",le="10"} 1
+http_request_size_bytes_bucket{method="POST",route="/test",le="+Inf"} 1
+http_request_size_bytes_sum{method="POST",route="/test"} 7
+http_request_size_bytes_count{method="POST",route="/test"} 1
+# HELP http_response_size_bytes Size of HTTP responses
+# TYPE http_response_size_bytes histogram
+http_response_size_bytes_bucket{method="POST",route="/test",le="1"} 0
+http_response_size_bytes_bucket{method="POST",route="/test",le="10"} 1
+http_response_size_bytes_bucket{method="POST",route="/test",le="+Inf"} 1
+http_response_size_bytes_sum{method="POST",route="/test"} 9
+http_response_size_bytes_count{method="POST",route="/test"} 1
+`
+	err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "http_request_size_bytes", "http_response_size_bytes")
+	assert.NoError(t, err)
 }
 
-func assertPrometheusMetrics(t *testing.T, prometheusMiddleware *middleware.PrometheusMiddleware) {
-	// Simulate different scenarios and assert Prometheus metrics
-
-	// Scenario 1: Successful request
-	// Simulate a successful request
-	// Verify that TotalRequests, ResponseStatus, and other metrics are incremented correctly
-	assertMetricsIncremented(t, prometheusMiddleware, http.StatusOK)
-
-	// Scenario 2: Request with a specific status code
-	// Simulate a request with a specific status code (e.g., 404)
-	// Verify that ResponseStatus metric is incremented correctly
-	assertMetricsIncremented(t, prometheusMiddleware, http.StatusNotFound)
-
-	// Scenario 4: Request with different request and response sizes
-	// Simulate requests and responses with different sizes
-	// Verify that RequestSize and ResponseSize metrics are observed correctly
-	// Note: Adjust the sizes as needed for your test case.
-	assertMetricsObserved(t, prometheusMiddleware, http.StatusOK, 1000, 2000)
-	assertMetricsObserved(t, prometheusMiddleware, http.StatusOK, 500, 1000)
-
-	// Scenario 5: Response time measurement
-	// Simulate requests and measure response time
-	// Verify that HttpDuration metric records response time
-	assertResponseTimeMeasured(t, prometheusMiddleware)
+func TestPrometheusMiddlewareDuration(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	// Create a handler failing slowly.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	r, m := newPrometheusRouter(handler,
+		middleware.WithPrometheusRegisterer(reg),
+		middleware.WithPrometheusBuckets([]float64{0.05, 10}),
+	)
+
+	// Perform the request
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/test", nil))
+
+	// The duration is observed once, labelled by method, route and status class.
+	observer, err := m.RequestDuration.GetMetricWithLabelValues(http.MethodDelete, "/test", "5xx")
+	if err != nil {
+		t.Fatalf("Failed to get duration histogram: %v", err)
+	}
+	var metric dto.Metric
+	if err := observer.(prometheus.Metric).Write(&metric); err != nil {
+		t.Fatalf("Failed to write duration histogram: %v", err)
+	}
+	histogram := metric.GetHistogram()
+	assert.Equal(t, uint64(1), histogram.GetSampleCount())
+	assert.GreaterOrEqual(t, histogram.GetSampleSum(), 0.1)
+	assert.Equal(t, uint64(0), histogram.GetBucket()[0].GetCumulativeCount())
+
+	// No body was written, so no time to first byte is observed.
+	assert.Equal(t, 0, testutil.CollectAndCount(m.TimeToFirstByte))
 }
 
-func assertMetricsIncremented(t *testing.T, prometheusMiddleware *middleware.PrometheusMiddleware, statusCode int) {
-	// Create a test request
-	req, _ := http.NewRequest("GET", "/test", nil)
-	res := httptest.NewRecorder()
-	res.WriteHeader(statusCode)
+func TestPrometheusMiddlewareInFlight(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	var inFlight float64
+
+	var m *middleware.PrometheusMiddleware
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight = testutil.ToFloat64(m.RequestsInFlight)
+	})
+	m = middleware.NewPrometheusMiddleware(handler, middleware.WithPrometheusRegisterer(reg))
 
 	// Perform the request
-	r := mux.NewRouter()
-	r.Use(prometheusMiddleware.ServeHTTP)
-	r.ServeHTTP(res, req)
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
 
-	// Get the current route's path
-	route := mux.CurrentRoute(req)
-	path, _ := route.GetPathTemplate()
+	assert.Equal(t, 1.0, inFlight)
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.RequestsInFlight))
+}
 
-	// Verify that ResponseStatus metric is incremented correctly
-	assert.Equal(t, 1.0, prometheusMiddleware.ResponseStatus.WithLabelValues(strconv.Itoa(statusCode)).Get())
+func TestPrometheusMiddlewareNativeHistograms(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := middleware.NewPrometheusMiddleware(http.NotFoundHandler(),
+		middleware.WithPrometheusRegisterer(reg),
+		middleware.WithPrometheusNativeHistograms(1.1),
+	)
 
-	// Verify that TotalRequests metric is incremented correctly
-	assert.Equal(t, 1.0, prometheusMiddleware.TotalRequests.WithLabelValues(path).Get())
+	// Perform the request
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
 
-	// Verify that RequestMethods metric is incremented correctly
-	assert.Equal(t, 1.0, prometheusMiddleware.RequestMethods.WithLabelValues(req.Method).Get())
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() == "http_request_duration_seconds" {
+			histogram := family.GetMetric()[0].GetHistogram()
+			assert.NotZero(t, histogram.GetSchema(), "Expected a native histogram schema")
+			assert.NotEmpty(t, histogram.GetBucket(), "Expected classic buckets to be kept")
+			return
+		}
+	}
+	t.Fatal("Expected http_request_duration_seconds to be gathered")
 }
 
-func assertMetricsObserved(t *testing.T, prometheusMiddleware *middleware.PrometheusMiddleware, statusCode int, requestSize, responseSize int64) {
-	// Create a test request
-	req, _ := http.NewRequest("GET", "/test", nil)
-	req.ContentLength = requestSize
-	res := httptest.NewRecorder()
-	res.WriteHeader(statusCode)
+func TestPrometheusMiddlewareDefaultRegisterer(t *testing.T) {
+	// Constructing the middleware twice must reuse the registered metrics.
+	first := middleware.NewPrometheusMiddleware(nil)
+	second := middleware.NewPrometheusMiddleware(nil)
+
+	assert.Same(t, first.RequestDuration, second.RequestDuration)
+	assert.Same(t, first.TimeToFirstByte, second.TimeToFirstByte)
+	assert.Equal(t, first.RequestsInFlight, second.RequestsInFlight)
+}
+
+func TestPrometheusMiddlewareNamespaceAndConstLabels(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	r, _ := newPrometheusRouter(http.NotFoundHandler(),
+		middleware.WithPrometheusRegisterer(reg),
+		middleware.WithPrometheusNamespace("shop", "api"),
+		middleware.WithPrometheusConstLabels(prometheus.Labels{"service": "orders", "version": "1.0"}),
+	)
 
 	// Perform the request
-	r := mux.NewRouter()
-	r.Use(prometheusMiddleware.ServeHTTP)
-	r.ServeHTTP(res, req)
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test", nil))
 
-	// Get the current route's path
-	route := mux.CurrentRoute(req)
-	path, _ := route.GetPathTemplate()
+	expected := `
+# HELP shop_api_http_requests_in_flight Number of HTTP requests being served
+# TYPE shop_api_http_requests_in_flight gauge
+shop_api_http_requests_in_flight{service="orders",version="1.0"} 0
+`
+	err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "shop_api_http_requests_in_flight")
+	assert.NoError(t, err)
+}
+
+func TestPrometheusMiddlewareBucketsAndObjectives(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	r, _ := newPrometheusRouter(http.NotFoundHandler(),
+		middleware.WithPrometheusRegisterer(reg),
+		middleware.WithPrometheusBuckets([]float64{0.1, 1}),
+		middleware.WithPrometheusObjectives(map[float64]float64{0.9: 0.01}),
+	)
+
+	// Perform the request
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test", nil))
 
-	// Verify that RequestSize and ResponseSize metrics are observed correctly
-	assert.Equal(t, float64(requestSize), prometheusMiddleware.RequestSize.WithLabelValues(path).Get())
-	assert.Equal(t, float64(responseSize), prometheusMiddleware.ResponseSize.WithLabelValues(path).Get())
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+
+	for _, family := range families {
+		switch family.GetName() {
+		case "http_request_duration_seconds", "http_time_to_first_byte_seconds":
+			var bounds []float64
+			for _, bucket := range family.GetMetric()[0].GetHistogram().GetBucket() {
+				bounds = append(bounds, bucket.GetUpperBound())
+			}
+			assert.Equal(t, []float64{0.1, 1}, bounds, family.GetName())
+		case "http_request_duration_quantiles_seconds":
+			var quantiles []float64
+			for _, quantile := range family.GetMetric()[0].GetSummary().GetQuantile() {
+				quantiles = append(quantiles, quantile.GetQuantile())
+			}
+			assert.Equal(t, []float64{0.9}, quantiles)
+		}
+	}
 }
 
-func assertResponseTimeMeasured(t *testing.T, prometheusMiddleware *middleware.PrometheusMiddleware) {
-	// Create a test request
-	req, _ := http.NewRequest("GET", "/test", nil)
+func TestPrometheusMiddlewareExemplars(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	r, _ := newPrometheusRouter(http.NotFoundHandler(), middleware.WithPrometheusRegisterer(reg))
+
+	// Perform a traced request
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Scrape the metrics in the OpenMetrics format
+	scrape := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	scrape.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
 	res := httptest.NewRecorder()
+	middleware.PrometheusHandler(reg).ServeHTTP(res, scrape)
 
-	// Simulate a delayed handler to measure response time
-	r := mux.NewRouter()
-	r.Use(prometheusMiddleware.ServeHTTP)
-	r.Handle("/test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Simulate a delay (e.g., 100 milliseconds)
-		time.Sleep(100 * time.Millisecond)
-		w.WriteHeader(http.StatusOK)
-	}))
-	r.ServeHTTP(res, req)
+	assert.Contains(t, res.Header().Get("Content-Type"), "application/openmetrics-text")
+	assert.Regexp(t, `http_request_duration_seconds_bucket\{method="GET",route="/test",status_class="4xx",le="[^"]+"\} 1 # \{trace_id="4bf92f3577b34da6a3ce929d0e0e4736"\}`, res.Body.String())
+}
+
+func TestPrometheusMiddlewareTraceIDExtractor(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	r, _ := newPrometheusRouter(http.NotFoundHandler(),
+		middleware.WithPrometheusRegisterer(reg),
+		middleware.WithPrometheusTraceID(func(r *http.Request) string { return r.Header.Get("X-Trace-ID") }),
+	)
+
+	// Perform a traced request
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.Header.Set("X-Trace-ID", "abc123")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Scrape the metrics in the OpenMetrics format
+	scrape := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	scrape.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+	res := httptest.NewRecorder()
+	middleware.PrometheusHandler(reg).ServeHTTP(res, scrape)
+
+	assert.Contains(t, res.Body.String(), `# {trace_id="abc123"}`)
+}
+
+func TestPrometheusMiddlewareInvalidTraceID(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	r, _ := newPrometheusRouter(http.NotFoundHandler(),
+		middleware.WithPrometheusRegisterer(reg),
+		middleware.WithPrometheusTraceID(func(r *http.Request) string { return r.Header.Get("X-Trace-ID") }),
+	)
+
+	// Perform requests with trace IDs not fitting in an exemplar
+	for _, traceID := range []string{strings.Repeat("a", 200), "\xff\xfe"} {
+		req := httptest.NewRequest(http.MethodGet, "/test", nil)
+		req.Header.Set("X-Trace-ID", traceID)
+		assert.NotPanics(t, func() { r.ServeHTTP(httptest.NewRecorder(), req) })
+	}
+
+	// The requests are observed without exemplar
+	scrape := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	scrape.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+	res := httptest.NewRecorder()
+	middleware.PrometheusHandler(reg).ServeHTTP(res, scrape)
+	assert.Regexp(t, `http_request_duration_seconds_count\{[^}]*\} 2`, res.Body.String())
+	assert.NotContains(t, res.Body.String(), "trace_id")
+}
+
+func TestPrometheusMiddlewareCardinalityLimiter(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	limiter := middleware.NewCardinalityLimiter(1)
+
+	// Serve every path, answering 404 on /missing.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+		}
+	})
+	m := middleware.NewPrometheusMiddleware(handler,
+		middleware.WithPrometheusRegisterer(reg),
+		middleware.WithPrometheusCardinalityLimiter(limiter),
+		middleware.WithPrometheusRouteResolver(func(r *http.Request) string { return r.URL.Path }),
+		middleware.WithPrometheusSizeBuckets([]float64{100}),
+	)
 
-	// Get the current route's path
-	route := mux.CurrentRoute(req)
-	path, _ := route.GetPathTemplate()
+	// Perform requests to distinct paths
+	for _, path := range []string{"/a", "/b", "/c", "/missing"} {
+		m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
 
-	// Verify that HttpDuration metric records response time
-	duration := prometheusMiddleware.HttpDuration.WithLabelValues(path).ObserveDuration()
-	assert.True(t, duration.Seconds() >= 0.1) // Response time should be at least 100 milliseconds
+	expected := `
+# HELP http_metric_label_values_folded_total Number of label values folded by the cardinality limiter
+# TYPE http_metric_label_values_folded_total counter
+http_metric_label_values_folded_total{label="route"} 2
+# HELP http_response_size_bytes Size of HTTP responses
+# TYPE http_response_size_bytes histogram
+http_response_size_bytes_bucket{method="GET",route="/a",le="100"} 1
+http_response_size_bytes_bucket{method="GET",route="/a",le="+Inf"} 1
+http_response_size_bytes_sum{method="GET",route="/a"} 0
+http_response_size_bytes_count{method="GET",route="/a"} 1
+http_response_size_bytes_bucket{method="GET",route="__not_found__",le="100"} 1
+http_response_size_bytes_bucket{method="GET",route="__not_found__",le="+Inf"} 1
+http_response_size_bytes_sum{method="GET",route="__not_found__"} 19
+http_response_size_bytes_count{method="GET",route="__not_found__"} 1
+http_response_size_bytes_bucket{method="GET",route="__other__",le="100"} 2
+http_response_size_bytes_bucket{method="GET",route="__other__",le="+Inf"} 2
+http_response_size_bytes_sum{method="GET",route="__other__"} 0
+http_response_size_bytes_count{method="GET",route="__other__"} 2
+`
+	err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "http_metric_label_values_folded_total", "http_response_size_bytes")
+	assert.NoError(t, err)
 }
@@ -1,54 +1,336 @@
 package middleware
 
 import (
+	"context"
+	"math"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/lab42/httplib"
 )
 
 // RateLimiter is a middleware for rate limiting requests.
+// Requests are counted against a bucket selected by the first matching class,
+// then by KeyFunc. Without either, all requests share a single global bucket.
 type RateLimiter struct {
-	requestsPerSecond int
-	bucket            chan struct{}
-	mu                sync.Mutex
+	RequestsPerSecond int                    // Number of requests allowed per second for each key not matched by a class.
+	KeyFunc           RateLimitKeyFunc       // Extracts the bucket key for requests not matched by a class.
+	Classes           []RateLimitClass       // Key classes with their own limits, checked in order.
+	Limiter           Limiter                // Limiter applying the algorithm. Defaults to buckets refilled once per second.
+	RejectHandler     RateLimitRejectHandler // Writes the response to rejected requests. Defaults to a plain 429.
+	Skipper           httplib.Matcher        // Skips the rate limiter for matching requests.
+
+	ticker *tickerLimiter
 }
 
+// RateLimitClass is a class of rate limit keys sharing the same limit.
+type RateLimitClass struct {
+	Name              string           // Name of the class, used to prefix its keys.
+	Key               RateLimitKeyFunc // Extracts the key. Requests with an empty key fall through to the next class.
+	RequestsPerSecond int              // Number of requests allowed per second for each key.
+}
+
+// RateLimitRejectHandler writes the response to a request rejected by a rate
+// limiter. The RateLimit headers are already set when it is called.
+type RateLimitRejectHandler func(w http.ResponseWriter, r *http.Request, res RateLimitResult)
+
 // NewRateLimiter creates a new RateLimiter with the specified requests per second limit.
+// The limiter must be closed to release its refill goroutine.
 func NewRateLimiter(requestsPerSecond int) *RateLimiter {
-	rl := &RateLimiter{
-		requestsPerSecond: requestsPerSecond,
-		bucket:            make(chan struct{}, requestsPerSecond),
+	return NewRateLimiterContext(context.Background(), requestsPerSecond)
+}
+
+// NewRateLimiterContext creates a new RateLimiter with the specified requests
+// per second limit, which is closed when ctx is done.
+func NewRateLimiterContext(ctx context.Context, requestsPerSecond int) *RateLimiter {
+	ticker := newTickerLimiter(ctx)
+	return &RateLimiter{
+		RequestsPerSecond: requestsPerSecond,
+		Limiter:           ticker,
+		ticker:            ticker,
+	}
+}
+
+// Close stops the refill goroutine of the default limiter. Its buckets are
+// not refilled anymore, so that requests served after Close are rejected
+// once they have drained them.
+func (rl *RateLimiter) Close() error {
+	if rl.ticker != nil {
+		rl.ticker.Close()
+	}
+	return nil
+}
+
+// Handler returns a handler that rate limits requests before passing them to next.
+// It panics if the rate limiter has no Limiter or if RequestsPerSecond is not positive.
+func (rl *RateLimiter) Handler(next http.Handler) http.Handler {
+	if rl.Limiter == nil {
+		panic("ratelimit: RateLimiter without Limiter, use NewRateLimiter")
+	}
+	if rl.RequestsPerSecond <= 0 {
+		panic("ratelimit: RateLimiter without positive RequestsPerSecond")
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rl.Skipper != nil && rl.Skipper(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Reject the request when the limiter is unavailable.
+		res, err := rl.take(r)
+		setRateLimitHeaders(w.Header(), res)
+		if err != nil || !res.Allowed {
+			rejectRateLimited(rl.RejectHandler, w, r, res)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// take takes a token from the bucket the request is counted against.
+func (rl *RateLimiter) take(r *http.Request) (RateLimitResult, error) {
+	key, limit := "", rl.RequestsPerSecond
+	matched := false
+	for _, class := range rl.Classes {
+		if k := class.Key(r); k != "" {
+			key, limit, matched = class.Name+":"+k, class.RequestsPerSecond, true
+			break
+		}
+	}
+	if !matched && rl.KeyFunc != nil {
+		key = rl.KeyFunc(r)
+	}
+
+	res, err := rl.Limiter.Take(r.Context(), "ratelimit:"+key, limit)
+	if err != nil {
+		return unavailableResult(limit), err
 	}
+	return res, nil
+}
 
-	// Fill the bucket initially.
-	for i := 0; i < requestsPerSecond; i++ {
-		rl.bucket <- struct{}{}
+// rejectRateLimited responds to a rejected request with h, or with a plain 429 if h is nil.
+func rejectRateLimited(h RateLimitRejectHandler, w http.ResponseWriter, r *http.Request, res RateLimitResult) {
+	if h != nil {
+		h(w, r, res)
+		return
 	}
+	http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+}
 
-	// Start a goroutine to replenish the bucket.
-	go rl.startRefill()
+// tickerLimiter is a Limiter that refills all of its buckets once per second
+// from a goroutine, started on first use.
+type tickerLimiter struct {
+	buckets    map[string]chan struct{}
+	refilledAt time.Time
+	mu         sync.Mutex
 
-	return rl
+	ctx    context.Context
+	cancel context.CancelFunc
+	start  sync.Once
 }
 
-func (rl *RateLimiter) startRefill() {
+// newTickerLimiter creates a new tickerLimiter, which is closed when ctx is done.
+func newTickerLimiter(ctx context.Context) *tickerLimiter {
+	ctx, cancel := context.WithCancel(ctx)
+	return &tickerLimiter{
+		buckets: make(map[string]chan struct{}),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// Close stops the refill goroutine.
+func (l *tickerLimiter) Close() {
+	l.cancel()
+}
+
+func (l *tickerLimiter) startRefill() {
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		rl.mu.Lock()
-		for i := len(rl.bucket); i < rl.requestsPerSecond; i++ {
-			rl.bucket <- struct{}{}
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.refill(now)
+		}
+	}
+}
+
+func (l *tickerLimiter) refill(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refilledAt = now
+	for key, bucket := range l.buckets {
+		// Drop buckets that were not used since the last refill, they are
+		// recreated full on the next request.
+		if len(bucket) == cap(bucket) {
+			delete(l.buckets, key)
+			continue
+		}
+		for i := len(bucket); i < cap(bucket); i++ {
+			bucket <- struct{}{}
 		}
-		rl.mu.Unlock()
 	}
 }
 
-func (rl *RateLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+// Take implements Limiter.
+func (l *tickerLimiter) Take(ctx context.Context, key string, limit int) (RateLimitResult, error) {
+	// Start a goroutine to replenish the buckets, counting the first second
+	// from now rather than from the creation of the limiter.
+	l.start.Do(func() {
+		l.mu.Lock()
+		l.refilledAt = time.Now()
+		l.mu.Unlock()
+		go l.startRefill()
+	})
+
+	if err := (RateLimitPolicy{Limit: limit}).Validate(); err != nil {
+		return RateLimitResult{}, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		// Fill new buckets initially.
+		bucket = make(chan struct{}, limit)
+		for i := 0; i < limit; i++ {
+			bucket <- struct{}{}
+		}
+		l.buckets[key] = bucket
+	}
+
+	// All buckets are refilled on the next tick of the refill goroutine.
+	res := RateLimitResult{
+		Limit: limit,
+		Reset: time.Second - time.Since(l.refilledAt),
+	}
 	select {
-	case <-rl.bucket:
-		next(w, r)
+	case <-bucket:
+		res.Allowed = true
 	default:
-		http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+		res.RetryAfter = res.Reset
+	}
+	res.Remaining = len(bucket)
+	return res, nil
+}
+
+// RateLimitResult describes the state of a bucket after taking a token from it.
+type RateLimitResult struct {
+	Allowed    bool          // Whether the request is allowed.
+	Limit      int           // Capacity of the bucket.
+	Remaining  int           // Number of requests still allowed.
+	Reset      time.Duration // Time until the bucket is full again.
+	RetryAfter time.Duration // Time until the next request is allowed, zero when allowed.
+}
+
+// unavailableResult is the result of a request rejected because the limiter
+// failed, asking the client to retry one second later.
+func unavailableResult(limit int) RateLimitResult {
+	return RateLimitResult{Limit: limit, Reset: time.Second, RetryAfter: time.Second}
+}
+
+// setRateLimitHeaders sets the RateLimit header fields defined by
+// draft-ietf-httpapi-ratelimit-headers, and Retry-After for rejected requests.
+// Retry-After is at least one second, so that clients never retry at once.
+func setRateLimitHeaders(h http.Header, res RateLimitResult) {
+	h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+	if !res.Allowed {
+		h.Set("Retry-After", strconv.Itoa(int(math.Max(1, float64(ceilSeconds(res.RetryAfter))))))
+	}
+}
+
+// ceilSeconds rounds a duration up to whole seconds.
+func ceilSeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int(math.Ceil(d.Seconds()))
+}
+
+// RateLimitMiddleware is a middleware that limits the request rate of each client.
+// Buckets are kept in Redis when a client is configured, so that several replicas
+// share the same limits, and in process memory otherwise.
+type RateLimitMiddleware struct {
+	Next      http.Handler
+	Skipper   httplib.Matcher       // Skips the middleware for matching requests.
+	Every     int                   // Number of requests allowed per second for each client.
+	Redis     redis.UniversalClient // Redis client used to store the buckets.
+	InMemory  *sync.Map             // In-memory bucket storage, used when Redis is nil.
+	Store     RateLimitStore        // Custom bucket storage, takes precedence over Redis and InMemory.
+	KeyFunc   RateLimitKeyFunc      // Extracts the client key. Defaults to the remote IP address.
+	Algorithm RateLimitAlgorithm    // Rate limiting algorithm. Defaults to TokenBucket.
+	Clock     func() time.Time      // Returns the current time. Defaults to time.Now.
+
+	RejectHandler RateLimitRejectHandler // Writes the response to rejected requests. Defaults to a plain 429.
+
+	once    sync.Once
+	limiter Limiter
+}
+
+// NewRateLimitMiddleware creates a new RateLimitMiddleware instance.
+// If store is nil, buckets are kept in process memory.
+// It panics if every is not positive.
+func NewRateLimitMiddleware(next http.Handler, every int, store RateLimitStore) *RateLimitMiddleware {
+	if err := (RateLimitPolicy{Limit: every}).Validate(); err != nil {
+		panic(err)
+	}
+	return &RateLimitMiddleware{
+		Next:  next,
+		Every: every,
+		Store: store,
+	}
+}
+
+// ServeHTTP is the middleware handler function that enforces the per-client rate limit.
+func (m *RateLimitMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.Skipper != nil && m.Skipper(r) {
+		m.Next.ServeHTTP(w, r)
+		return
 	}
+
+	m.once.Do(func() {
+		var store RateLimitStore
+		switch {
+		case m.Store != nil:
+			store = m.Store
+		case m.Redis != nil:
+			store = NewRedisRateLimitStore(m.Redis)
+		default:
+			store = NewMemoryRateLimitStore(m.InMemory)
+		}
+		m.limiter = &StoreLimiter{Store: store, Algorithm: m.Algorithm, Clock: m.Clock}
+	})
+
+	// Fall back to the remote IP address when the key cannot be extracted.
+	var key string
+	if m.KeyFunc != nil {
+		key = m.KeyFunc(r)
+	}
+	if key == "" {
+		key = clientIP(r)
+	}
+
+	// Reject the request when the store is unavailable.
+	res, err := m.limiter.Take(r.Context(), "ratelimit:"+key, m.Every)
+	if err != nil {
+		res = unavailableResult(m.Every)
+	}
+	setRateLimitHeaders(w.Header(), res)
+	if err != nil || !res.Allowed {
+		rejectRateLimited(m.RejectHandler, w, r, res)
+		return
+	}
+
+	m.Next.ServeHTTP(w, r)
 }
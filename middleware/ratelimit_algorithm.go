@@ -0,0 +1,200 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// RateLimitAlgorithm selects how requests are counted against a limit.
+type RateLimitAlgorithm int
+
+const (
+	// TokenBucket refills a bucket of Limit tokens continuously over Period.
+	TokenBucket RateLimitAlgorithm = iota
+	// GCRA (generic cell rate algorithm) spaces requests evenly over Period
+	// while allowing bursts of up to Limit requests.
+	GCRA
+	// SlidingWindowLog records the time of every request made during the last Period.
+	SlidingWindowLog
+	// SlidingWindowCounter approximates a sliding window by weighting the
+	// request count of the previous fixed window.
+	SlidingWindowCounter
+)
+
+// String returns the name of the algorithm.
+func (a RateLimitAlgorithm) String() string {
+	switch a {
+	case TokenBucket:
+		return "token_bucket"
+	case GCRA:
+		return "gcra"
+	case SlidingWindowLog:
+		return "sliding_window_log"
+	case SlidingWindowCounter:
+		return "sliding_window_counter"
+	default:
+		return "unknown"
+	}
+}
+
+// RateLimitPolicy describes a limit of Limit requests per Period.
+type RateLimitPolicy struct {
+	Algorithm RateLimitAlgorithm
+	Limit     int           // Number of requests allowed per period.
+	Period    time.Duration // Length of the period. Defaults to one second.
+}
+
+// Validate returns an error when the policy cannot limit requests: when the
+// limit is not positive, the period negative or the algorithm unknown.
+func (p RateLimitPolicy) Validate() error {
+	switch {
+	case p.Limit <= 0:
+		return fmt.Errorf("ratelimit: limit %d is not positive", p.Limit)
+	case p.Period < 0:
+		return fmt.Errorf("ratelimit: period %v is negative", p.Period)
+	case p.Algorithm < TokenBucket || p.Algorithm > SlidingWindowCounter:
+		return fmt.Errorf("ratelimit: unknown algorithm %d", p.Algorithm)
+	}
+	return nil
+}
+
+// period returns the length of the period.
+func (p RateLimitPolicy) period() time.Duration {
+	if p.Period <= 0 {
+		return time.Second
+	}
+	return p.Period
+}
+
+// interval returns the time it takes to earn one request back.
+func (p RateLimitPolicy) interval() time.Duration {
+	return p.period() / time.Duration(p.Limit)
+}
+
+// Limiter decides whether a request counted against key is allowed.
+type Limiter interface {
+	// Take counts a request against key, allowing limit requests per period,
+	// and reports the state of its bucket.
+	Take(ctx context.Context, key string, limit int) (RateLimitResult, error)
+}
+
+// StoreLimiter is a Limiter applying an algorithm to state kept in a RateLimitStore.
+type StoreLimiter struct {
+	Store     RateLimitStore
+	Algorithm RateLimitAlgorithm
+	Period    time.Duration    // Length of the period. Defaults to one second.
+	Clock     func() time.Time // Returns the current time. Defaults to time.Now.
+}
+
+// NewLimiter creates a new StoreLimiter instance.
+// It panics if the algorithm is unknown or the period negative.
+func NewLimiter(store RateLimitStore, algorithm RateLimitAlgorithm, period time.Duration) *StoreLimiter {
+	if err := (RateLimitPolicy{Algorithm: algorithm, Limit: 1, Period: period}).Validate(); err != nil {
+		panic(err)
+	}
+	return &StoreLimiter{
+		Store:     store,
+		Algorithm: algorithm,
+		Period:    period,
+	}
+}
+
+// Take implements Limiter.
+func (l *StoreLimiter) Take(ctx context.Context, key string, limit int) (RateLimitResult, error) {
+	now := time.Now
+	if l.Clock != nil {
+		now = l.Clock
+	}
+
+	policy := RateLimitPolicy{Algorithm: l.Algorithm, Limit: limit, Period: l.Period}
+	return l.Store.Take(ctx, key, policy, now())
+}
+
+// tokenBucketResult computes the result of a take from the tokens left in a bucket.
+func tokenBucketResult(allowed bool, tokens float64, p RateLimitPolicy) RateLimitResult {
+	interval := float64(p.interval())
+	res := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     p.Limit,
+		Remaining: int(tokens),
+		Reset:     time.Duration((float64(p.Limit) - tokens) * interval),
+	}
+	if !allowed {
+		res.RetryAfter = time.Duration((1 - tokens) * interval)
+	}
+	return res
+}
+
+// gcraResult computes the result of a take from the theoretical arrival time
+// (TAT) of the next request.
+func gcraResult(allowed bool, tat, now time.Time, p RateLimitPolicy) RateLimitResult {
+	if tat.Before(now) {
+		tat = now
+	}
+
+	// Requests are allowed as long as the TAT stays within one period from now.
+	res := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     p.Limit,
+		Remaining: int((p.period() - tat.Sub(now)) / p.interval()),
+		Reset:     tat.Sub(now),
+	}
+	if !allowed {
+		res.RetryAfter = tat.Add(p.interval() - p.period()).Sub(now)
+	}
+	return res
+}
+
+// slidingWindowLogResult computes the result of a take from the number of
+// requests logged during the last period and the oldest and newest of them.
+func slidingWindowLogResult(allowed bool, count int, oldest, newest, now time.Time, p RateLimitPolicy) RateLimitResult {
+	res := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     p.Limit,
+		Remaining: p.Limit - count,
+		Reset:     newest.Add(p.period()).Sub(now),
+	}
+	if !allowed {
+		res.RetryAfter = oldest.Add(p.period()).Sub(now)
+	}
+	return res
+}
+
+// slidingWindow returns the start of the fixed window containing now and the
+// weight of the previous window.
+func slidingWindow(now time.Time, p RateLimitPolicy) (time.Time, float64) {
+	period := p.period()
+	start := now.Truncate(period)
+	return start, 1 - float64(now.Sub(start))/float64(period)
+}
+
+// slidingWindowCounterResult computes the result of a take from the request
+// counts of the previous and current fixed windows.
+func slidingWindowCounterResult(allowed bool, prev, curr int, now time.Time, p RateLimitPolicy) RateLimitResult {
+	period := p.period()
+	start, weight := slidingWindow(now, p)
+	estimate := float64(prev)*weight + float64(curr)
+
+	res := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     p.Limit,
+		Remaining: int(math.Max(0, float64(p.Limit)-estimate)),
+		Reset:     start.Add(period).Sub(now),
+	}
+	if allowed {
+		return res
+	}
+
+	// Find when the weighted count leaves room for one more request, either in
+	// the current window or, once it is full, in the next one.
+	if curr >= p.Limit {
+		fraction := 1 - float64(p.Limit-1)/float64(curr)
+		res.RetryAfter = start.Add(period + time.Duration(fraction*float64(period))).Sub(now)
+	} else {
+		fraction := 1 - float64(p.Limit-1-curr)/float64(prev)
+		res.RetryAfter = start.Add(time.Duration(fraction * float64(period))).Sub(now)
+	}
+	return res
+}
@@ -0,0 +1,236 @@
+package middleware_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redismock/v8"
+	"github.com/lab42/httplib/internal"
+	"github.com/lab42/httplib/middleware"
+)
+
+// fakeClock is a clock advanced manually by tests.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestStoreLimiter_Algorithms(t *testing.T) {
+	// Each step takes a token after advancing the clock by the given duration.
+	type step struct {
+		advance    time.Duration
+		allowed    bool
+		remaining  int
+		retryAfter time.Duration
+	}
+
+	tests := []struct {
+		algorithm middleware.RateLimitAlgorithm
+		steps     []step
+	}{
+		{
+			algorithm: middleware.TokenBucket,
+			steps: []step{
+				{0, true, 1, 0},
+				{0, true, 0, 0},
+				{0, false, 0, 500 * time.Millisecond},
+				{500 * time.Millisecond, true, 0, 0},
+			},
+		},
+		{
+			algorithm: middleware.GCRA,
+			steps: []step{
+				{0, true, 1, 0},
+				{0, true, 0, 0},
+				{0, false, 0, 500 * time.Millisecond},
+				{250 * time.Millisecond, false, 0, 250 * time.Millisecond},
+				{250 * time.Millisecond, true, 0, 0},
+			},
+		},
+		{
+			algorithm: middleware.SlidingWindowLog,
+			steps: []step{
+				{0, true, 1, 0},
+				{600 * time.Millisecond, true, 0, 0},
+				{200 * time.Millisecond, false, 0, 200 * time.Millisecond},
+				{200 * time.Millisecond, true, 0, 0},
+			},
+		},
+		{
+			algorithm: middleware.SlidingWindowCounter,
+			steps: []step{
+				{0, true, 1, 0},
+				{0, true, 0, 0},
+				{0, false, 0, 1500 * time.Millisecond},
+				{1250 * time.Millisecond, false, 0, 250 * time.Millisecond},
+				{250 * time.Millisecond, true, 0, 0},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.algorithm.String(), func(t *testing.T) {
+			clock := &fakeClock{now: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+			limiter := middleware.NewLimiter(middleware.NewMemoryRateLimitStore(nil), tt.algorithm, time.Second)
+			limiter.Clock = clock.Now
+
+			for i, s := range tt.steps {
+				clock.Advance(s.advance)
+				res, err := limiter.Take(context.Background(), "key", 2)
+				if err != nil {
+					t.Fatalf("Step %d: unexpected error: %v", i, err)
+				}
+				if res.Allowed != s.allowed || res.Remaining != s.remaining || res.RetryAfter != s.retryAfter {
+					t.Errorf("Step %d: expected allowed=%v remaining=%d retryAfter=%v, but got %+v", i, s.allowed, s.remaining, s.retryAfter, res)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitMiddleware_GCRARedis(t *testing.T) {
+	rdb, mock := redismock.NewClientMock()
+	clock := &fakeClock{now: time.UnixMilli(1672531200000)}
+
+	// Create a RateLimitMiddleware using GCRA for testing.
+	middleware := middleware.RateLimitMiddleware{
+		Next:      http.HandlerFunc(internal.DummyHandler),
+		Every:     2,
+		Redis:     rdb,
+		Algorithm: middleware.GCRA,
+		Clock:     clock.Now,
+	}
+
+	// The script stores the theoretical arrival time of the next request.
+	mock.Regexp().ExpectEvalSha(`^[0-9a-f]{40}$`, []string{"ratelimit:127.0.0.1"}, float64(500), int64(1000), int64(1672531200000), int64(60000)).
+		SetVal([]interface{}{int64(0), "1672531201000"})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status code %d, but got %d", http.StatusTooManyRequests, rr.Code)
+	}
+	if rr.Header().Get("RateLimit-Reset") != "1" || rr.Header().Get("Retry-After") != "1" {
+		t.Errorf("Unexpected rate limit headers %v", rr.Header())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRateLimitMiddleware_SlidingWindowLogRedis(t *testing.T) {
+	rdb, mock := redismock.NewClientMock()
+	clock := &fakeClock{now: time.UnixMilli(1672531200000)}
+
+	// Create a RateLimitMiddleware using a sliding window log for testing.
+	middleware := middleware.RateLimitMiddleware{
+		Next:      http.HandlerFunc(internal.DummyHandler),
+		Every:     2,
+		Redis:     rdb,
+		Algorithm: middleware.SlidingWindowLog,
+		Clock:     clock.Now,
+	}
+
+	// The script logs the request unless the window is full, and returns the
+	// oldest and newest logged requests.
+	mock.Regexp().ExpectEvalSha(`^[0-9a-f]{40}$`, []string{"ratelimit:127.0.0.1"}, 2, int64(1000), int64(1672531200000), `^\d+-[0-9a-z]+$`, int64(60000)).
+		SetVal([]interface{}{int64(0), int64(2), "1672531199500", "1672531199900"})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status code %d, but got %d", http.StatusTooManyRequests, rr.Code)
+	}
+	if rr.Header().Get("RateLimit-Remaining") != "0" || rr.Header().Get("Retry-After") != "1" {
+		t.Errorf("Unexpected rate limit headers %v", rr.Header())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRateLimitMiddleware_SlidingWindowCounterRedis(t *testing.T) {
+	rdb, mock := redismock.NewClientMock()
+	clock := &fakeClock{now: time.UnixMilli(1672531200250)}
+
+	// Create a RateLimitMiddleware using a sliding window counter for testing.
+	middleware := middleware.RateLimitMiddleware{
+		Next:      http.HandlerFunc(internal.DummyHandler),
+		Every:     2,
+		Redis:     rdb,
+		Algorithm: middleware.SlidingWindowCounter,
+		Clock:     clock.Now,
+	}
+
+	// The counters of the current and previous windows share a hash tag, so
+	// that they live in the same Redis Cluster slot.
+	keys := []string{`^\{ratelimit:127\.0\.0\.1\}:1672531200000$`, `^\{ratelimit:127\.0\.0\.1\}:1672531199000$`}
+	mock.Regexp().ExpectEvalSha(`^[0-9a-f]{40}$`, keys, 2, 0.75, int64(1000), int64(60000)).
+		SetVal([]interface{}{int64(0), int64(2), int64(1)})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, req)
+
+	// 2 requests weighted by 0.75 and 1 request exceed the limit.
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status code %d, but got %d", http.StatusTooManyRequests, rr.Code)
+	}
+	if rr.Header().Get("RateLimit-Remaining") != "0" || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("Unexpected rate limit headers %v", rr.Header())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRateLimitPolicy_Validate(t *testing.T) {
+	tests := map[string]middleware.RateLimitPolicy{
+		"zero limit":        {Limit: 0},
+		"negative limit":    {Limit: -1},
+		"negative period":   {Limit: 1, Period: -time.Second},
+		"unknown algorithm": {Limit: 1, Algorithm: middleware.RateLimitAlgorithm(42)},
+	}
+	for name, policy := range tests {
+		if policy.Validate() == nil {
+			t.Errorf("Expected an error for a policy with %s", name)
+		}
+	}
+	if err := (middleware.RateLimitPolicy{Limit: 1}).Validate(); err != nil {
+		t.Errorf("Expected a valid policy, but got %v", err)
+	}
+
+	// Stores report invalid policies instead of rejecting every request.
+	_, err := middleware.NewMemoryRateLimitStore(nil).Take(context.Background(), "key", middleware.RateLimitPolicy{}, time.Now())
+	if err == nil {
+		t.Error("Expected an error for a policy without limit")
+	}
+
+	// Invalid limiters cannot be constructed.
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected NewLimiter to panic for a negative period")
+		}
+	}()
+	middleware.NewLimiter(middleware.NewMemoryRateLimitStore(nil), middleware.GCRA, -time.Second)
+}
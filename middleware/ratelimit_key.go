@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RateLimitKeyFunc extracts the key identifying the bucket a request is counted against.
+// An empty key means the extractor does not apply to the request.
+type RateLimitKeyFunc func(r *http.Request) string
+
+// KeyByIP keys requests by the IP address of the client.
+func KeyByIP() RateLimitKeyFunc {
+	return clientIP
+}
+
+// KeyByHeader keys requests by the value of a request header, such as X-API-Key.
+func KeyByHeader(name string) RateLimitKeyFunc {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// KeyByContext keys requests by a value stored in the request context, such as
+// the authenticated principal or JWT subject set by an authentication middleware.
+func KeyByContext(key interface{}) RateLimitKeyFunc {
+	return func(r *http.Request) string {
+		switch v := r.Context().Value(key).(type) {
+		case nil:
+			return ""
+		case string:
+			return v
+		default:
+			return fmt.Sprint(v)
+		}
+	}
+}
+
+// KeyByRoute keys requests by method and path.
+func KeyByRoute() RateLimitKeyFunc {
+	return func(r *http.Request) string {
+		return r.Method + " " + r.URL.Path
+	}
+}
+
+// CombineKeys keys requests by the combination of several keys, for example
+// the API key and the route. The key is empty if any of the keys is empty.
+func CombineKeys(keyFuncs ...RateLimitKeyFunc) RateLimitKeyFunc {
+	return func(r *http.Request) string {
+		keys := make([]string, 0, len(keyFuncs))
+		for _, keyFunc := range keyFuncs {
+			key := keyFunc(r)
+			if key == "" {
+				return ""
+			}
+			keys = append(keys, key)
+		}
+		return strings.Join(keys, "|")
+	}
+}
+
+// clientIP returns the IP address of the client that sent the request.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
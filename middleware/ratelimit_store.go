@@ -0,0 +1,379 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RateLimitStore persists rate limit state shared between requests.
+type RateLimitStore interface {
+	// Take counts a request against the bucket identified by key using the
+	// algorithm of the policy, and reports the state of the bucket.
+	Take(ctx context.Context, key string, policy RateLimitPolicy, now time.Time) (RateLimitResult, error)
+}
+
+// MemoryRateLimitStore is a RateLimitStore that keeps buckets in process memory.
+// Buckets left idle for two periods are back to their initial state, and are
+// evicted by a sweep run at most once per SweepInterval, so that memory does
+// not grow with the number of clients ever seen.
+type MemoryRateLimitStore struct {
+	Buckets       *sync.Map     // Buckets keyed by client key.
+	SweepInterval time.Duration // Minimum interval between sweeps of idle buckets. Defaults to one minute.
+
+	lastSweep atomic.Int64 // Unix nanoseconds of the last sweep.
+}
+
+// NewMemoryRateLimitStore creates a new MemoryRateLimitStore instance.
+// If buckets is nil, a new map is allocated.
+func NewMemoryRateLimitStore(buckets *sync.Map) *MemoryRateLimitStore {
+	if buckets == nil {
+		buckets = &sync.Map{}
+	}
+	return &MemoryRateLimitStore{Buckets: buckets}
+}
+
+// memoryBucket is the rate limit state for a single key.
+type memoryBucket struct {
+	mu      sync.Mutex
+	expires time.Time // When the bucket is back to its initial state.
+	evicted bool      // Whether the bucket was removed from the store.
+
+	// TokenBucket state.
+	tokens     float64
+	lastRefill time.Time
+
+	// GCRA state.
+	tat time.Time
+
+	// SlidingWindowLog state.
+	log []time.Time
+
+	// SlidingWindowCounter state.
+	window     time.Time
+	prev, curr int
+}
+
+// Take implements RateLimitStore.
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, policy RateLimitPolicy, now time.Time) (RateLimitResult, error) {
+	if err := policy.Validate(); err != nil {
+		return RateLimitResult{}, err
+	}
+
+	s.sweep(now)
+
+	// Retry with a new bucket when the sweep evicted the loaded one meanwhile.
+	for {
+		v, _ := s.Buckets.LoadOrStore(key, &memoryBucket{tokens: float64(policy.Limit), lastRefill: now})
+		if res, ok := v.(*memoryBucket).take(policy, now); ok {
+			return res, nil
+		}
+	}
+}
+
+// sweep evicts the buckets back to their initial state, unless the last sweep
+// happened less than SweepInterval ago.
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	interval := s.SweepInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	last := s.lastSweep.Load()
+	if now.UnixNano()-last < int64(interval) || !s.lastSweep.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+
+	s.Buckets.Range(func(key, v interface{}) bool {
+		b := v.(*memoryBucket)
+		b.mu.Lock()
+		if !now.Before(b.expires) {
+			b.evicted = true
+			s.Buckets.Delete(key)
+		}
+		b.mu.Unlock()
+		return true
+	})
+}
+
+// take counts a request against the bucket. It reports false when the bucket
+// was evicted and must not be used anymore.
+func (b *memoryBucket) take(p RateLimitPolicy, now time.Time) (RateLimitResult, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.evicted {
+		return RateLimitResult{}, false
+	}
+
+	// Every algorithm forgets the requests made more than two periods ago.
+	b.expires = now.Add(2 * p.period())
+
+	switch p.Algorithm {
+	case GCRA:
+		return b.takeGCRA(p, now), true
+	case SlidingWindowLog:
+		return b.takeSlidingWindowLog(p, now), true
+	case SlidingWindowCounter:
+		return b.takeSlidingWindowCounter(p, now), true
+	default:
+		return b.takeTokenBucket(p, now), true
+	}
+}
+
+func (b *memoryBucket) takeTokenBucket(p RateLimitPolicy, now time.Time) RateLimitResult {
+	// Refill the bucket proportionally to the time elapsed since the last refill.
+	if elapsed := now.Sub(b.lastRefill); elapsed > 0 {
+		b.tokens = math.Min(float64(p.Limit), b.tokens+float64(elapsed)/float64(p.interval()))
+		b.lastRefill = now
+	}
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	return tokenBucketResult(allowed, b.tokens, p)
+}
+
+func (b *memoryBucket) takeGCRA(p RateLimitPolicy, now time.Time) RateLimitResult {
+	tat := b.tat
+	if tat.Before(now) {
+		tat = now
+	}
+
+	next := tat.Add(p.interval())
+	allowed := !next.Add(-p.period()).After(now)
+	if allowed {
+		b.tat = next
+	}
+	return gcraResult(allowed, b.tat, now, p)
+}
+
+func (b *memoryBucket) takeSlidingWindowLog(p RateLimitPolicy, now time.Time) RateLimitResult {
+	// Forget requests older than one period.
+	cutoff := now.Add(-p.period())
+	i := 0
+	for i < len(b.log) && !b.log[i].After(cutoff) {
+		i++
+	}
+	b.log = b.log[i:]
+
+	allowed := len(b.log) < p.Limit
+	if allowed {
+		b.log = append(b.log, now)
+	}
+
+	oldest, newest := now, now
+	if len(b.log) > 0 {
+		oldest, newest = b.log[0], b.log[len(b.log)-1]
+	}
+	return slidingWindowLogResult(allowed, len(b.log), oldest, newest, now, p)
+}
+
+func (b *memoryBucket) takeSlidingWindowCounter(p RateLimitPolicy, now time.Time) RateLimitResult {
+	// Roll the counters over when a new window starts.
+	start, weight := slidingWindow(now, p)
+	switch {
+	case start.Equal(b.window):
+	case start.Equal(b.window.Add(p.period())):
+		b.window, b.prev, b.curr = start, b.curr, 0
+	default:
+		b.window, b.prev, b.curr = start, 0, 0
+	}
+
+	allowed := float64(b.prev)*weight+float64(b.curr)+1 <= float64(p.Limit)
+	if allowed {
+		b.curr++
+	}
+	return slidingWindowCounterResult(allowed, b.prev, b.curr, now, p)
+}
+
+// tokenBucketScript atomically refills and takes a token from a bucket stored
+// as a hash with "tokens" and "lastRefill" (Unix milliseconds) fields.
+var tokenBucketScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local state = redis.call("HMGET", KEYS[1], "tokens", "lastRefill")
+local tokens = tonumber(state[1])
+local lastRefill = tonumber(state[2])
+if tokens == nil or lastRefill == nil then
+	tokens = limit
+	lastRefill = now
+end
+
+local elapsed = now - lastRefill
+if elapsed > 0 then
+	tokens = math.min(limit, tokens + elapsed * limit / period)
+	lastRefill = now
+end
+
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "lastRefill", lastRefill)
+redis.call("PEXPIRE", KEYS[1], math.max(period, tonumber(ARGV[4])))
+return {allowed, tostring(tokens)}
+`)
+
+// gcraScript atomically advances the theoretical arrival time (Unix
+// milliseconds) stored in a string key.
+var gcraScript = redis.NewScript(`
+local interval = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local tat = tonumber(redis.call("GET", KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+
+local allowed = 0
+local next = tat + interval
+if next - period <= now then
+	tat = next
+	allowed = 1
+	redis.call("SET", KEYS[1], tostring(tat), "PX", math.max(math.ceil(tat - now), tonumber(ARGV[4])))
+end
+return {allowed, tostring(tat)}
+`)
+
+// slidingWindowLogScript atomically logs a request in a sorted set scored by
+// Unix milliseconds.
+var slidingWindowLogScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - period)
+local count = redis.call("ZCARD", KEYS[1])
+
+local allowed = 0
+if count < limit then
+	redis.call("ZADD", KEYS[1], now, ARGV[4])
+	redis.call("PEXPIRE", KEYS[1], math.max(period, tonumber(ARGV[5])))
+	count = count + 1
+	allowed = 1
+end
+
+local oldest = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")[2] or now
+local newest = redis.call("ZRANGE", KEYS[1], -1, -1, "WITHSCORES")[2] or now
+return {allowed, count, tostring(oldest), tostring(newest)}
+`)
+
+// slidingWindowCounterScript atomically increments the counter of the current
+// window (KEYS[1]) given the counter of the previous one (KEYS[2]).
+var slidingWindowCounterScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local weight = tonumber(ARGV[2])
+local period = tonumber(ARGV[3])
+
+local curr = tonumber(redis.call("GET", KEYS[1]) or "0")
+local prev = tonumber(redis.call("GET", KEYS[2]) or "0")
+
+local allowed = 0
+if prev * weight + curr + 1 <= limit then
+	curr = redis.call("INCR", KEYS[1])
+	redis.call("PEXPIRE", KEYS[1], math.max(period * 2, tonumber(ARGV[4])))
+	allowed = 1
+end
+return {allowed, prev, curr}
+`)
+
+// RedisRateLimitStore is a RateLimitStore that keeps buckets in Redis, so that
+// several replicas of a service share the same limits. Token buckets are
+// stored as hashes with "tokens" and "lastRefill" fields.
+type RedisRateLimitStore struct {
+	Client redis.Scripter
+	TTL    time.Duration // Expiry of idle buckets, extended to the time the algorithm needs to forget their requests.
+}
+
+// NewRedisRateLimitStore creates a new RedisRateLimitStore instance.
+func NewRedisRateLimitStore(client redis.Scripter) *RedisRateLimitStore {
+	return &RedisRateLimitStore{Client: client, TTL: time.Minute}
+}
+
+// Take implements RateLimitStore.
+func (s *RedisRateLimitStore) Take(ctx context.Context, key string, policy RateLimitPolicy, now time.Time) (RateLimitResult, error) {
+	if err := policy.Validate(); err != nil {
+		return RateLimitResult{}, err
+	}
+
+	period := policy.period().Milliseconds()
+	nowMs := now.UnixMilli()
+	ttl := s.TTL.Milliseconds()
+
+	switch policy.Algorithm {
+	case GCRA:
+		interval := float64(policy.interval()) / float64(time.Millisecond)
+		reply, err := s.run(ctx, gcraScript, []string{key}, 2, interval, period, nowMs, ttl)
+		if err != nil {
+			return RateLimitResult{}, err
+		}
+		return gcraResult(reply[0] == 1, unixMilli(reply[1]), now, policy), nil
+
+	case SlidingWindowLog:
+		member := strconv.FormatInt(now.UnixNano(), 10) + "-" + strconv.FormatInt(rand.Int63(), 36)
+		reply, err := s.run(ctx, slidingWindowLogScript, []string{key}, 4, policy.Limit, period, nowMs, member, ttl)
+		if err != nil {
+			return RateLimitResult{}, err
+		}
+		return slidingWindowLogResult(reply[0] == 1, int(reply[1]), unixMilli(reply[2]), unixMilli(reply[3]), now, policy), nil
+
+	case SlidingWindowCounter:
+		// The key is a hash tag, so that both windows hash to the same
+		// Redis Cluster slot.
+		start, weight := slidingWindow(now, policy)
+		keys := []string{
+			fmt.Sprintf("{%s}:%d", key, start.UnixMilli()),
+			fmt.Sprintf("{%s}:%d", key, start.Add(-policy.period()).UnixMilli()),
+		}
+		reply, err := s.run(ctx, slidingWindowCounterScript, keys, 3, policy.Limit, weight, period, ttl)
+		if err != nil {
+			return RateLimitResult{}, err
+		}
+		return slidingWindowCounterResult(reply[0] == 1, int(reply[1]), int(reply[2]), now, policy), nil
+
+	default:
+		reply, err := s.run(ctx, tokenBucketScript, []string{key}, 2, policy.Limit, period, nowMs, ttl)
+		if err != nil {
+			return RateLimitResult{}, err
+		}
+		return tokenBucketResult(reply[0] == 1, reply[1], policy), nil
+	}
+}
+
+// run runs a script expected to reply with n numbers.
+func (s *RedisRateLimitStore) run(ctx context.Context, script *redis.Script, keys []string, n int, args ...interface{}) ([]float64, error) {
+	reply, err := script.Run(ctx, s.Client, keys, args...).Slice()
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) != n {
+		return nil, fmt.Errorf("ratelimit: unexpected script reply %v", reply)
+	}
+
+	values := make([]float64, n)
+	for i, v := range reply {
+		values[i], err = strconv.ParseFloat(fmt.Sprint(v), 64)
+		if err != nil {
+			return nil, fmt.Errorf("ratelimit: unexpected script reply %v: %w", reply, err)
+		}
+	}
+	return values, nil
+}
+
+// unixMilli converts fractional Unix milliseconds to a time.
+func unixMilli(ms float64) time.Time {
+	return time.Unix(0, int64(ms*float64(time.Millisecond)))
+}
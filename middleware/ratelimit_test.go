@@ -1,20 +1,26 @@
 package middleware_test
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
-	"strconv"
+	"runtime"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/go-redis/redismock/v8"
+	"github.com/lab42/httplib"
 	"github.com/lab42/httplib/internal"
 	"github.com/lab42/httplib/middleware"
 )
 
+// scriptSHAPattern matches the SHA1 of the scripts run by RedisRateLimitStore.
+const scriptSHAPattern = `^[0-9a-f]{40}$`
+
 func TestRateLimitMiddleware_Redis(t *testing.T) {
 	rdb, mock := redismock.NewClientMock()
 
@@ -26,74 +32,105 @@ func TestRateLimitMiddleware_Redis(t *testing.T) {
 		InMemory: nil,
 	}
 
-	// Create a test request.
-	req := httptest.NewRequest("GET", "/", nil)
-
-	// Create a response recorder to capture the response.
-	rr := httptest.NewRecorder()
-
 	// Define the IP address for testing.
 	ip := "127.0.0.1"
 
-	// Create a Redis transaction pipeline that increments tokens and sets the last refill time.
-	mock.ExpectHIncrBy("ratelimit:"+ip, "tokens", int64(2)).SetVal(2)
-
-	mock.ExpectHGet("ratelimit:"+ip, "lastRefill").SetVal(
-		strconv.FormatInt(time.Now().Add(-5*time.Second).Unix(), 10),
-	)
-	mock.ExpectHSet("ratelimit:"+ip, "lastRefill").SetVal(1)
-	mock.ExpectHIncrBy("ratelimit:"+ip, "tokens", int64(2)).SetVal(3)
+	// Expect the token bucket script to allow two requests and reject the third.
+	for _, reply := range [][]interface{}{{int64(1), "1"}, {int64(1), "0"}, {int64(0), "0.5"}} {
+		mock.Regexp().ExpectEvalSha(scriptSHAPattern, []string{"ratelimit:" + ip}, 2, int64(1000), `^\d+$`, int64(60000)).SetVal(reply)
+	}
 
 	// Execute the middleware 3 times in quick succession.
+	codes := make([]int, 0, 3)
+	var rr *httptest.ResponseRecorder
 	for i := 0; i < 3; i++ {
+		// Create a test request.
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = ip + ":1234"
+
+		// Create a response recorder to capture the response.
+		rr = httptest.NewRecorder()
 		middleware.ServeHTTP(rr, req)
+		codes = append(codes, rr.Code)
 	}
 
 	// Check if the response status code is 200 for the first two requests.
-	if status := rr.Code; status != http.StatusOK {
-		t.Errorf("Expected status code 200, but got %d", status)
+	for _, status := range codes[:2] {
+		if status != http.StatusOK {
+			t.Errorf("Expected status code 200, but got %d", status)
+		}
 	}
 
 	// Check if the response status code is 429 (Too Many Requests) for the third request.
 	// Also, check if the response body contains the rate limit exceeded message.
-	if status := rr.Code; status != http.StatusTooManyRequests {
+	if status := codes[2]; status != http.StatusTooManyRequests {
 		t.Errorf("Expected status code 429 (Too Many Requests), but got %d", status)
 	}
 
 	expectedError := "Rate limit exceeded"
-	if rr.Body.String() != expectedError {
+	if strings.Trim(rr.Body.String(), "\n") != expectedError {
 		t.Errorf("Expected response body '%s', but got '%s'", expectedError, rr.Body.String())
 	}
+
+	// Check the rate limit headers computed from the bucket state.
+	expectedHeaders := map[string]string{
+		"RateLimit-Limit":     "2",
+		"RateLimit-Remaining": "0",
+		"RateLimit-Reset":     "1",
+		"Retry-After":         "1",
+	}
+	for name, value := range expectedHeaders {
+		if rr.Header().Get(name) != value {
+			t.Errorf("Expected %s header '%s', but got '%s'", name, value, rr.Header().Get(name))
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
 }
 
 func TestRateLimitMiddleware_InMemory(t *testing.T) {
 	// Create a RateLimitMiddleware instance with in-memory storage for testing.
 	middleware := middleware.RateLimitMiddleware{
-		Next:     http.HandlerFunc(dummyHandler), // Define a dummy handler for testing.
-		Every:    2,                              // Allow 2 requests per second.
+		Next:     http.HandlerFunc(internal.DummyHandler), // Define a dummy handler for testing.
+		Every:    2,                                       // Allow 2 requests per second.
 		Redis:    nil,
 		InMemory: &sync.Map{},
 	}
 
-	// Create a test request.
-	req := httptest.NewRequest("GET", "/", nil)
-
-	// Create a response recorder to capture the responses.
-	rr := httptest.NewRecorder()
-
 	// Execute the middleware 3 times in quick succession.
+	codes := make([]int, 0, 3)
 	for i := 0; i < 3; i++ {
+		// Create a test request.
+		req := httptest.NewRequest("GET", "/", nil)
+
+		// Create a response recorder to capture the responses.
+		rr := httptest.NewRecorder()
 		middleware.ServeHTTP(rr, req)
+		codes = append(codes, rr.Code)
 	}
 
 	// Check if the response code for the first two requests is OK.
-	if rr.Code != http.StatusOK {
-		t.Errorf("Expected status code %d, but got %d", http.StatusOK, rr.Code)
+	for _, status := range codes[:2] {
+		if status != http.StatusOK {
+			t.Errorf("Expected status code %d, but got %d", http.StatusOK, status)
+		}
 	}
 
 	// The third request should be rate-limited and return a 429 status code.
-	if rr.Code != http.StatusTooManyRequests {
-		t.Errorf("Expected status code %d, but got %d", http.StatusTooManyRequests, rr.Code)
+	if codes[2] != http.StatusTooManyRequests {
+		t.Errorf("Expected status code %d, but got %d", http.StatusTooManyRequests, codes[2])
+	}
+
+	// Requests from another client use a separate bucket.
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "198.51.100.7:1234"
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d for another client, but got %d", http.StatusOK, rr.Code)
 	}
 }
 
@@ -103,25 +140,27 @@ func TestRateLimitMiddleware_RateLimitExceededError(t *testing.T) {
 
 	// Create a RateLimitMiddleware instance for testing.
 	middleware := middleware.RateLimitMiddleware{
-		Next:     http.HandlerFunc(dummyHandler), // Define a dummy handler for testing.
-		Every:    2,                              // Allow 2 requests per second.
+		Next:     http.HandlerFunc(internal.DummyHandler), // Define a dummy handler for testing.
+		Every:    2,                                       // Allow 2 requests per second.
 		Redis:    rdb,
 		InMemory: &sync.Map{},
 	}
 
+	// Make the token bucket script fail.
+	mock.Regexp().ExpectEvalSha(scriptSHAPattern, []string{"ratelimit:127.0.0.1"}, 2, int64(1000), `^\d+$`, int64(60000)).SetErr(errors.New("mock error"))
+
 	// Create a test request.
 	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
 
 	// Create a response recorder to capture the response.
 	rr := httptest.NewRecorder()
 
-	// Create a mock Redis transaction pipeline that returns an error.
-	mock.ExpectHIncrBy("ratelimit:127.0.0.1", "tokens", int64(2)).SetErr(errors.New("mock error"))
-	mock.ExpectHGet("ratelimit:127.0.0.1", "lastRefill").SetVal("1633290000")
+	middleware.ServeHTTP(rr, req)
 
-	// Execute the middleware 3 times in quick succession.
-	for i := 0; i < 3; i++ {
-		middleware.ServeHTTP(rr, req)
+	// Requests are rejected while the store is unavailable.
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status code %d, but got %d", http.StatusTooManyRequests, rr.Code)
 	}
 
 	// Check if the response body contains the rate limit exceeded error message.
@@ -129,4 +168,290 @@ func TestRateLimitMiddleware_RateLimitExceededError(t *testing.T) {
 	if strings.Trim(rr.Body.String(), "\n") != expectedError {
 		t.Errorf("Expected response body '%s', but got '%s'", expectedError, rr.Body.String())
 	}
+
+	// Clients are still told when to retry.
+	if rr.Header().Get("Retry-After") != "1" || rr.Header().Get("RateLimit-Limit") != "2" {
+		t.Errorf("Unexpected rate limit headers %v", rr.Header())
+	}
+}
+
+// staticLimiter is a Limiter always returning the same result.
+type staticLimiter struct {
+	res middleware.RateLimitResult
+}
+
+func (l staticLimiter) Take(ctx context.Context, key string, limit int) (middleware.RateLimitResult, error) {
+	return l.res, nil
+}
+
+func TestRateLimiter_RetryAfterAtLeastOneSecond(t *testing.T) {
+	// Create a rate limiter whose bucket is about to be refilled.
+	rl := &middleware.RateLimiter{RequestsPerSecond: 1, Limiter: staticLimiter{middleware.RateLimitResult{Limit: 1}}}
+
+	// Execute the middleware.
+	rr := httptest.NewRecorder()
+	rl.Handler(http.HandlerFunc(internal.DummyHandler)).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status code %d, but got %d", http.StatusTooManyRequests, rr.Code)
+	}
+	if rr.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected Retry-After header '1', but got '%s'", rr.Header().Get("Retry-After"))
+	}
+}
+
+func TestRateLimiter_KeyFunc(t *testing.T) {
+	// Create a RateLimiter keyed by API key, allowing 1 request per second per key.
+	rl := middleware.NewRateLimiter(1)
+	defer rl.Close()
+	rl.KeyFunc = middleware.KeyByHeader("X-API-Key")
+
+	serve := func(apiKey string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-API-Key", apiKey)
+		rr := httptest.NewRecorder()
+		rl.Handler(http.HandlerFunc(internal.DummyHandler)).ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Each key has its own bucket.
+	if code := serve("a"); code != http.StatusOK {
+		t.Errorf("Expected status code %d, but got %d", http.StatusOK, code)
+	}
+	if code := serve("b"); code != http.StatusOK {
+		t.Errorf("Expected status code %d, but got %d", http.StatusOK, code)
+	}
+	if code := serve("a"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected status code %d, but got %d", http.StatusTooManyRequests, code)
+	}
+}
+
+func TestRateLimiter_Classes(t *testing.T) {
+	type principalKey struct{}
+
+	// Authenticated principals get 2 requests per second, anonymous clients share 1 per IP.
+	rl := middleware.NewRateLimiter(1)
+	defer rl.Close()
+	rl.KeyFunc = middleware.KeyByIP()
+	rl.Classes = []middleware.RateLimitClass{
+		{Name: "user", Key: middleware.KeyByContext(principalKey{}), RequestsPerSecond: 2},
+	}
+
+	serve := func(principal string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		if principal != "" {
+			req = req.WithContext(context.WithValue(req.Context(), principalKey{}, principal))
+		}
+		rr := httptest.NewRecorder()
+		rl.Handler(http.HandlerFunc(internal.DummyHandler)).ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if code := serve("alice"); code != want {
+			t.Errorf("Request %d: expected status code %d, but got %d", i, want, code)
+		}
+	}
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		if code := serve(""); code != want {
+			t.Errorf("Anonymous request %d: expected status code %d, but got %d", i, want, code)
+		}
+	}
+}
+
+func TestCombineKeys(t *testing.T) {
+	req := httptest.NewRequest("POST", "/orders", nil)
+	req.Header.Set("X-API-Key", "secret")
+
+	key := middleware.CombineKeys(middleware.KeyByHeader("X-API-Key"), middleware.KeyByRoute())(req)
+	if key != "secret|POST /orders" {
+		t.Errorf("Expected key 'secret|POST /orders', but got '%s'", key)
+	}
+
+	// A missing component yields an empty key.
+	req.Header.Del("X-API-Key")
+	if key := middleware.CombineKeys(middleware.KeyByHeader("X-API-Key"), middleware.KeyByRoute())(req); key != "" {
+		t.Errorf("Expected empty key, but got '%s'", key)
+	}
+}
+
+func TestRateLimiter_Headers(t *testing.T) {
+	rl := middleware.NewRateLimiter(2)
+	defer rl.Close()
+
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		rr := httptest.NewRecorder()
+		rl.Handler(http.HandlerFunc(internal.DummyHandler)).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Allowed requests report the remaining quota but no Retry-After.
+	rr := serve()
+	if rr.Header().Get("RateLimit-Limit") != "2" || rr.Header().Get("RateLimit-Remaining") != "1" {
+		t.Errorf("Unexpected rate limit headers %v", rr.Header())
+	}
+	if rr.Header().Get("Retry-After") != "" {
+		t.Errorf("Expected no Retry-After header, but got '%s'", rr.Header().Get("Retry-After"))
+	}
+
+	// Rejected requests tell the client when to retry.
+	serve()
+	rr = serve()
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status code %d, but got %d", http.StatusTooManyRequests, rr.Code)
+	}
+	if rr.Header().Get("RateLimit-Remaining") != "0" || rr.Header().Get("Retry-After") != "1" {
+		t.Errorf("Unexpected rate limit headers %v", rr.Header())
+	}
+}
+
+func TestMemoryRateLimitStore_Refill(t *testing.T) {
+	store := middleware.NewMemoryRateLimitStore(nil)
+	policy := middleware.RateLimitPolicy{Algorithm: middleware.TokenBucket, Limit: 2}
+	now := time.Now()
+
+	// Drain the bucket.
+	for i := 0; i < 2; i++ {
+		if res, _ := store.Take(context.Background(), "key", policy, now); !res.Allowed {
+			t.Fatalf("Expected request %d to be allowed", i)
+		}
+	}
+	res, _ := store.Take(context.Background(), "key", policy, now)
+	if res.Allowed || res.RetryAfter != 500*time.Millisecond || res.Reset != time.Second {
+		t.Errorf("Unexpected result %+v", res)
+	}
+
+	// Half a second later, one token has been refilled.
+	res, _ = store.Take(context.Background(), "key", policy, now.Add(500*time.Millisecond))
+	if !res.Allowed || res.Remaining != 0 {
+		t.Errorf("Unexpected result %+v", res)
+	}
+}
+
+func TestMemoryRateLimitStore_Evict(t *testing.T) {
+	store := middleware.NewMemoryRateLimitStore(nil)
+	store.SweepInterval = time.Second
+	policy := middleware.RateLimitPolicy{Algorithm: middleware.TokenBucket, Limit: 2}
+	now := time.Now()
+
+	store.Take(context.Background(), "idle", policy, now)
+	store.Take(context.Background(), "active", policy, now)
+
+	// The idle bucket survives sweeps until it has been idle for two periods.
+	store.Take(context.Background(), "active", policy, now.Add(time.Second))
+	if _, ok := store.Buckets.Load("idle"); !ok {
+		t.Error("Expected idle bucket not to be evicted yet")
+	}
+
+	store.Take(context.Background(), "active", policy, now.Add(2*time.Second))
+	if _, ok := store.Buckets.Load("idle"); ok {
+		t.Error("Expected idle bucket to be evicted")
+	}
+	if _, ok := store.Buckets.Load("active"); !ok {
+		t.Error("Expected active bucket to be kept")
+	}
+}
+
+func TestRateLimiter_Use(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", internal.DummyHandler)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Render a custom body for rejected requests.
+	rl := middleware.NewRateLimiterContext(ctx, 1)
+	rl.RejectHandler = func(w http.ResponseWriter, r *http.Request, res middleware.RateLimitResult) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintf(w, `{"retry_after_ms":%d}`, res.RetryAfter.Milliseconds())
+	}
+
+	// The rate limiter plugs into Use like any other middleware.
+	handler := httplib.Use(mux, rl.Handler)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, but got %d", http.StatusOK, rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status code %d, but got %d", http.StatusTooManyRequests, rr.Code)
+	}
+	if !strings.HasPrefix(rr.Body.String(), `{"retry_after_ms":`) {
+		t.Errorf("Expected custom response body, but got '%s'", rr.Body.String())
+	}
+}
+
+func TestRateLimiter_ResetAfterIdleStart(t *testing.T) {
+	// Create a rate limiter that serves its first request well after its creation.
+	rl := middleware.NewRateLimiter(1)
+	defer rl.Close()
+	time.Sleep(1100 * time.Millisecond)
+
+	handler := rl.Handler(http.HandlerFunc(internal.DummyHandler))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+	// The bucket is refilled one second after the first request.
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status code %d, but got %d", http.StatusTooManyRequests, rr.Code)
+	}
+	if rr.Header().Get("RateLimit-Reset") != "1" {
+		t.Errorf("Expected RateLimit-Reset header '1', but got '%s'", rr.Header().Get("RateLimit-Reset"))
+	}
+}
+
+func TestRateLimiter_Close(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	rl := middleware.NewRateLimiter(1)
+	rl.Handler(http.HandlerFunc(internal.DummyHandler)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if err := rl.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The refill goroutine exits once the limiter is closed.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("Expected %d goroutines after Close, but got %d", before, n)
+	}
+}
+
+func TestRateLimiter_CustomLimiter(t *testing.T) {
+	// Rate limiters with a custom limiter have no refill goroutine to stop.
+	rl := &middleware.RateLimiter{RequestsPerSecond: 1, Limiter: staticLimiter{middleware.RateLimitResult{Allowed: true, Limit: 1}}}
+	if err := rl.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	rl.Handler(http.HandlerFunc(internal.DummyHandler)).ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, but got %d", http.StatusOK, rr.Code)
+	}
+
+	// Rate limiters without limiter or limit cannot be used.
+	invalid := map[string]*middleware.RateLimiter{
+		"limiter": {RequestsPerSecond: 1},
+		"limit":   {Limiter: rl.Limiter},
+	}
+	for name, rl := range invalid {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected Handler to panic without %s", name)
+				}
+			}()
+			rl.Handler(http.HandlerFunc(internal.DummyHandler))
+		}()
+	}
 }
@@ -4,11 +4,14 @@ import (
 	"fmt"
 	"net/http"
 	"runtime/debug"
+
+	"github.com/lab42/httplib"
 )
 
 // RecoveryMiddleware is a middleware that recovers from panics and logs errors.
 type RecoveryMiddleware struct {
-	Next http.Handler
+	Next    http.Handler
+	Skipper httplib.Matcher // Skips the middleware for matching requests.
 }
 
 // NewRecoveryMiddleware creates a new RecoveryMiddleware instance.
@@ -18,8 +21,35 @@ func NewRecoveryMiddleware(next http.Handler) *RecoveryMiddleware {
 	}
 }
 
+// RecoveryOption configures a RecoveryMiddleware.
+type RecoveryOption func(*RecoveryMiddleware)
+
+// WithRecoverySkipper skips the middleware for requests matching skipper.
+func WithRecoverySkipper(skipper httplib.Matcher) RecoveryOption {
+	return func(m *RecoveryMiddleware) {
+		m.Skipper = skipper
+	}
+}
+
+// Recovery returns a middleware that recovers from panics and logs errors.
+func Recovery(opts ...RecoveryOption) func(http.Handler) http.Handler {
+	template := NewRecoveryMiddleware(nil)
+	for _, opt := range opts {
+		opt(template)
+	}
+
+	return chainable(template, func(m *RecoveryMiddleware, next http.Handler) {
+		m.Next = next
+	})
+}
+
 // ServeHTTP is the middleware handler function that recovers from panics and logs errors.
 func (m *RecoveryMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.Skipper != nil && m.Skipper(r) {
+		m.Next.ServeHTTP(w, r)
+		return
+	}
+
 	defer func() {
 		if r := recover(); r != nil {
 			// Recover from the panic.
@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/mux"
+)
+
+// RouteResolver returns the route a request was matched against, such as
+// "/users/{id}", or an empty string when the route is unknown. Routers record
+// the matched route while serving the request, so resolvers are called after
+// the next handler returns.
+type RouteResolver func(r *http.Request) string
+
+// DefaultRouteResolver resolves routes from http.ServeMux, gorilla/mux and chi,
+// falling back to the normalized request path.
+var DefaultRouteResolver = FirstRoute(ServeMuxRoute, GorillaRoute, ChiRoute, NormalizedPath)
+
+// FirstRoute returns a RouteResolver returning the first route resolved by resolvers.
+func FirstRoute(resolvers ...RouteResolver) RouteResolver {
+	return func(r *http.Request) string {
+		for _, resolve := range resolvers {
+			if route := resolve(r); route != "" {
+				return route
+			}
+		}
+		return ""
+	}
+}
+
+// GorillaRoute resolves the path template of the gorilla/mux route matching
+// the request. The middleware must be applied inside the router, with
+// Router.Use, for the route to be visible.
+func GorillaRoute(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+	return template
+}
+
+// ChiRoute resolves the chi route pattern matching the request. The
+// middleware must be applied inside the router, with Router.Use, for the
+// route to be visible.
+func ChiRoute(r *http.Request) string {
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil {
+		return ""
+	}
+	return rctx.RoutePattern()
+}
+
+// routeIDPattern matches path segments that identify a resource rather than
+// a route: numbers, UUIDs and long hexadecimal strings.
+var routeIDPattern = regexp.MustCompile(`^(?:\d+|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|[0-9a-fA-F]{16,})$`)
+
+// NormalizedPath returns the request path with the segments identifying a
+// resource, such as numeric IDs and UUIDs, replaced by ":id", which keeps
+// the number of distinct routes bounded.
+func NormalizedPath(r *http.Request) string {
+	segments := strings.Split(r.URL.Path, "/")
+	for i, segment := range segments {
+		if routeIDPattern.MatchString(segment) {
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,11 @@
+//go:build !go1.23
+
+package middleware
+
+import "net/http"
+
+// ServeMuxRoute resolves the http.ServeMux pattern matching the request.
+// Patterns are only recorded on the request since Go 1.23.
+func ServeMuxRoute(r *http.Request) string {
+	return ""
+}
@@ -0,0 +1,17 @@
+//go:build go1.23
+
+package middleware
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ServeMuxRoute resolves the http.ServeMux pattern matching the request,
+// without its method.
+func ServeMuxRoute(r *http.Request) string {
+	if _, path, ok := strings.Cut(r.Pattern, " "); ok {
+		return strings.TrimLeft(path, " \t")
+	}
+	return r.Pattern
+}
@@ -0,0 +1,53 @@
+//go:build go1.23
+
+//go:debug httpmuxgo121=0
+
+package middleware_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lab42/httplib"
+	"github.com/lab42/httplib/middleware"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeMuxRoute(t *testing.T) {
+	var route string
+
+	// Create a ServeMux wrapped by a middleware resolving the pattern.
+	mux := http.NewServeMux()
+	mux.Handle("GET /users/{id}", http.NotFoundHandler())
+	handler := httplib.Use(mux, routeRecorder(middleware.ServeMuxRoute, &route))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/123", nil))
+	assert.Equal(t, "/users/{id}", route)
+
+	// Unmatched requests resolve no route.
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/unknown", nil))
+	assert.Equal(t, "", route)
+}
+
+func TestZeroLogFromContextServeMuxRoute(t *testing.T) {
+	var buf bytes.Buffer
+
+	// Create a ServeMux whose handler logs with the request-scoped logger.
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		middleware.ZeroLogFromContext(r.Context()).Info().Msg("Handler log")
+	})
+	handler := httplib.Use(mux, middleware.ZeroLog(middleware.WithZeroLogLogger(zerolog.New(&buf))))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/123", nil))
+
+	// The handler log carries the pattern matched after the logger was made.
+	events := zerologEvents(t, &buf)
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "/users/{id}", events[0]["route"])
+		assert.Equal(t, "/users/{id}", events[1]["route"])
+	}
+}
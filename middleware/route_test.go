@@ -0,0 +1,112 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/mux"
+	"github.com/lab42/httplib/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// routeRecorder returns a middleware storing the route resolved by resolve
+// after the next handler returns.
+func routeRecorder(resolve middleware.RouteResolver, route *string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r)
+			*route = resolve(r)
+		})
+	}
+}
+
+func TestGorillaRoute(t *testing.T) {
+	var route string
+
+	// Create a gorilla router resolving routes from inside the router.
+	r := mux.NewRouter()
+	r.Use(routeRecorder(middleware.GorillaRoute, &route))
+	r.Handle("/users/{id}", http.NotFoundHandler())
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/123", nil))
+	assert.Equal(t, "/users/{id}", route)
+
+	// Requests outside a gorilla router resolve no route.
+	assert.Equal(t, "", middleware.GorillaRoute(httptest.NewRequest(http.MethodGet, "/users/123", nil)))
+}
+
+func TestChiRoute(t *testing.T) {
+	var route string
+
+	// Create a chi router resolving routes from inside the router.
+	r := chi.NewRouter()
+	r.Use(routeRecorder(middleware.ChiRoute, &route))
+	r.Route("/users", func(r chi.Router) {
+		r.Get("/{id}", http.NotFound)
+	})
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/123", nil))
+	assert.Equal(t, "/users/{id}", route)
+
+	// Requests outside a chi router resolve no route.
+	assert.Equal(t, "", middleware.ChiRoute(httptest.NewRequest(http.MethodGet, "/users/123", nil)))
+}
+
+func TestNormalizedPath(t *testing.T) {
+	tests := map[string]string{
+		"/":                     "/",
+		"/users":                "/users",
+		"/users/123":            "/users/:id",
+		"/users/123/orders/456": "/users/:id/orders/:id",
+		"/orders/3f2504e0-4f89-11d3-9a0c-0305e82c3301":      "/orders/:id",
+		"/commits/9fceb02d0ae598e95dc970b74767f19372d61af8": "/commits/:id",
+		"/users/me": "/users/me",
+		"/v2/users": "/v2/users",
+	}
+
+	for path, expected := range tests {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		assert.Equal(t, expected, middleware.NormalizedPath(req), path)
+	}
+}
+
+func TestFirstRoute(t *testing.T) {
+	empty := func(r *http.Request) string { return "" }
+	fixed := func(r *http.Request) string { return "/fixed" }
+
+	req := httptest.NewRequest(http.MethodGet, "/users/123", nil)
+	assert.Equal(t, "/fixed", middleware.FirstRoute(empty, fixed, middleware.NormalizedPath)(req))
+	assert.Equal(t, "/users/:id", middleware.FirstRoute(empty, middleware.NormalizedPath)(req))
+	assert.Equal(t, "", middleware.FirstRoute(empty)(req))
+}
+
+func TestPrometheusMiddlewareWithoutGorilla(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	// Wrap a plain handler, outside of any router.
+	m := middleware.NewPrometheusMiddleware(http.NotFoundHandler(), middleware.WithPrometheusRegisterer(reg))
+
+	// Perform the request
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/42", nil))
+
+	expected := `
+# HELP http_response_size_bytes Size of HTTP responses
+# TYPE http_response_size_bytes histogram
+http_response_size_bytes_bucket{method="GET",route="/users/:id",le="100"} 1
+http_response_size_bytes_bucket{method="GET",route="/users/:id",le="1000"} 1
+http_response_size_bytes_bucket{method="GET",route="/users/:id",le="10000"} 1
+http_response_size_bytes_bucket{method="GET",route="/users/:id",le="100000"} 1
+http_response_size_bytes_bucket{method="GET",route="/users/:id",le="1e+06"} 1
+http_response_size_bytes_bucket{method="GET",route="/users/:id",le="1e+07"} 1
+http_response_size_bytes_bucket{method="GET",route="/users/:id",le="+Inf"} 1
+http_response_size_bytes_sum{method="GET",route="/users/:id"} 19
+http_response_size_bytes_count{method="GET",route="/users/:id"} 1
+`
+	err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "http_response_size_bytes")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,163 @@
+//go:build go1.21
+
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/lab42/httplib"
+)
+
+// SlogMiddleware is a middleware that logs one access-log entry per HTTP
+// request using log/slog. Entries are logged at the info level, at the warn
+// level for 4xx responses and at the error level for 5xx responses, with the
+// same fields as the ZapMiddleware and the ZeroLogMiddleware.
+type SlogMiddleware struct {
+	Next            http.Handler
+	Skipper         httplib.Matcher // Skips the middleware for matching requests.
+	Logger          *slog.Logger
+	SensitiveKeys   []string // Sensitive field keys to be obfuscated
+	AccessLogConfig          // Settings of the access log, shared with the other access-log middlewares.
+}
+
+// NewSlogMiddleware creates a new SlogMiddleware instance.
+func NewSlogMiddleware(next http.Handler, logger *slog.Logger, sensitiveKeys []string) *SlogMiddleware {
+	return &SlogMiddleware{Next: next, Logger: logger, SensitiveKeys: sensitiveKeys}
+}
+
+// SlogOption configures a SlogMiddleware.
+type SlogOption func(*SlogMiddleware)
+
+// WithSlogSkipper skips the middleware for requests matching skipper.
+func WithSlogSkipper(skipper httplib.Matcher) SlogOption {
+	return func(m *SlogMiddleware) {
+		m.Skipper = skipper
+	}
+}
+
+// WithSlogSensitiveKeys sets the field keys to be obfuscated.
+func WithSlogSensitiveKeys(keys ...string) SlogOption {
+	return func(m *SlogMiddleware) {
+		m.SensitiveKeys = keys
+	}
+}
+
+// WithSlogAccessLog configures the access log with opts.
+func WithSlogAccessLog(opts ...AccessLogOption) SlogOption {
+	return func(m *SlogMiddleware) {
+		for _, opt := range opts {
+			opt(&m.AccessLogConfig)
+		}
+	}
+}
+
+// Slog returns a middleware that logs HTTP request information using logger,
+// or slog.Default when nil.
+func Slog(logger *slog.Logger, opts ...SlogOption) func(http.Handler) http.Handler {
+	template := NewSlogMiddleware(nil, logger, nil)
+	for _, opt := range opts {
+		opt(template)
+	}
+
+	return chainable(template, func(m *SlogMiddleware, next http.Handler) {
+		m.Next = next
+	})
+}
+
+// ServeHTTP is the middleware handler function that logs HTTP request information.
+func (m *SlogMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.Skipper != nil && m.Skipper(r) {
+		m.Next.ServeHTTP(w, r)
+		return
+	}
+
+	logger := m.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	// Make a logger enriched with the request metadata available to handlers,
+	// adding the route when they log
+	route := m.AccessLogConfig.lazyRoute(&r)
+	contextLogger := slog.New(slogRouteHandler{logger.Handler(), route}).With(slogArgs(m.AccessLogConfig.contextFields(r))...)
+	r = r.WithContext(context.WithValue(r.Context(), slogContextKey{}, contextLogger))
+
+	entry := m.AccessLogConfig.serve(m.Next, w, r, m.SensitiveKeys)
+
+	// Log a single entry, at a level depending on the response status
+	level := slog.LevelInfo
+	switch entry.Level {
+	case accessLogError:
+		level = slog.LevelError
+	case accessLogWarn:
+		level = slog.LevelWarn
+	}
+
+	logger.LogAttrs(r.Context(), level, accessLogMessage, slogAttrs(entry.Fields)...)
+}
+
+// slogRouteHandler is a slog.Handler adding the route, resolved when a record
+// is logged, to the records of the handler it wraps.
+type slogRouteHandler struct {
+	slog.Handler
+	route func() string
+}
+
+// Handle implements slog.Handler.
+func (h slogRouteHandler) Handle(ctx context.Context, record slog.Record) error {
+	record = record.Clone()
+	record.AddAttrs(slog.String("route", h.route()))
+	return h.Handler.Handle(ctx, record)
+}
+
+// WithAttrs implements slog.Handler.
+func (h slogRouteHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return slogRouteHandler{h.Handler.WithAttrs(attrs), h.route}
+}
+
+// WithGroup implements slog.Handler.
+func (h slogRouteHandler) WithGroup(name string) slog.Handler {
+	return slogRouteHandler{h.Handler.WithGroup(name), h.route}
+}
+
+// slogContextKey is the context key of the request-scoped slog logger.
+type slogContextKey struct{}
+
+// SlogFromContext returns the request-scoped logger stored in ctx by the
+// SlogMiddleware, or slog.Default when there is none.
+func SlogFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(slogContextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// slogAttrs converts access-log fields to slog attributes.
+func slogAttrs(fields []accessLogField) []slog.Attr {
+	attrs := make([]slog.Attr, 0, len(fields))
+	for _, f := range fields {
+		switch v := f.Value.(type) {
+		case string:
+			attrs = append(attrs, slog.String(f.Key, v))
+		case int:
+			attrs = append(attrs, slog.Int(f.Key, v))
+		case int64:
+			attrs = append(attrs, slog.Int64(f.Key, v))
+		default:
+			attrs = append(attrs, slog.Any(f.Key, v))
+		}
+	}
+	return attrs
+}
+
+// slogArgs converts access-log fields to arguments of slog.Logger.With.
+func slogArgs(fields []accessLogField) []interface{} {
+	attrs := slogAttrs(fields)
+	args := make([]interface{}, len(attrs))
+	for i, attr := range attrs {
+		args[i] = attr
+	}
+	return args
+}
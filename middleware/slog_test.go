@@ -0,0 +1,130 @@
+//go:build go1.21
+
+package middleware_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/lab42/httplib/middleware"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestSlogMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+
+	// Create a handler failing with a body.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("Bad Gateway"))
+	})
+
+	// Create a Slog middleware logging obfuscated parameters.
+	m := middleware.Slog(slog.New(slog.NewJSONHandler(&buf, nil)),
+		middleware.WithSlogAccessLog(middleware.WithAccessLogParams()),
+		middleware.WithSlogSensitiveKeys("password"),
+	)(handler)
+
+	// Create a test request.
+	req := httptest.NewRequest(http.MethodGet, "/orders/42?password=secret", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Request-ID", "req-1")
+
+	// Execute the middleware.
+	m.ServeHTTP(httptest.NewRecorder(), req)
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Failed to decode entry %q: %v", buf.String(), err)
+	}
+	assert.Equal(t, "ERROR", entry["level"])
+	assert.Equal(t, "HTTP request", entry["msg"])
+	assert.Equal(t, "/orders/:id", entry["route"])
+	assert.Equal(t, float64(http.StatusBadGateway), entry["status"])
+	assert.Equal(t, float64(11), entry["bytes"])
+	assert.Equal(t, "192.0.2.1", entry["remote_ip"])
+	assert.Equal(t, "req-1", entry["request_id"])
+	assert.Equal(t, map[string]interface{}{"password": "********"}, entry["params"])
+}
+
+func TestAccessLogFieldsAreIdentical(t *testing.T) {
+	var slogBuf, zapBuf, zerologBuf bytes.Buffer
+
+	zapLogger := zap.New(zapcore.NewCore(
+		zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
+		zapcore.AddSync(&zapBuf),
+		zapcore.DebugLevel,
+	))
+
+	middlewares := []func(http.Handler) http.Handler{
+		middleware.Slog(slog.New(slog.NewJSONHandler(&slogBuf, nil)), middleware.WithSlogAccessLog(middleware.WithAccessLogParams(), middleware.WithAccessLogHeaders()), middleware.WithSlogSensitiveKeys("token")),
+		middleware.Zap(zapLogger, middleware.WithZapAccessLog(middleware.WithAccessLogParams(), middleware.WithAccessLogHeaders()), middleware.WithZapSensitiveKeys("token")),
+		middleware.ZeroLog(middleware.WithZeroLogLogger(zerolog.New(&zerologBuf)), middleware.WithZeroLogAccessLog(middleware.WithAccessLogParams(), middleware.WithAccessLogHeaders()), middleware.WithZeroLogSensitiveKeys("token")),
+	}
+	for _, mw := range middlewares {
+		req := httptest.NewRequest(http.MethodGet, "/?token=secret", nil)
+		req.AddCookie(&http.Cookie{Name: "token", Value: "secret"})
+		mw(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Compare the fields of the entries, leaving out the logger specific ones.
+	fields := func(buf *bytes.Buffer) map[string]interface{} {
+		var entry map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Fatalf("Failed to decode entry %q: %v", buf.String(), err)
+		}
+		for _, key := range []string{"level", "msg", "message", "time", "ts", "duration_ms"} {
+			delete(entry, key)
+		}
+		return entry
+	}
+	keys := func(entry map[string]interface{}) []string {
+		var keys []string
+		for key := range entry {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	expected := fields(&slogBuf)
+	assert.Equal(t, []string{"bytes", "cookies", "headers", "method", "params", "path", "remote_ip", "request_id", "route", "status", "trace_id", "user_agent"}, keys(expected))
+	assert.Equal(t, expected, fields(&zapBuf))
+	assert.Equal(t, expected, fields(&zerologBuf))
+}
+
+func TestSlogFromContext(t *testing.T) {
+	var buf bytes.Buffer
+
+	// Create a handler logging with the request-scoped logger.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		middleware.SlogFromContext(r.Context()).Info("Handler log")
+	})
+
+	// Create a test request.
+	req := httptest.NewRequest(http.MethodGet, "/users/42", nil)
+	req.Header.Set("X-Request-ID", "req-1")
+
+	// Execute the middleware.
+	middleware.Slog(slog.New(slog.NewJSONHandler(&buf, nil)))(handler).ServeHTTP(httptest.NewRecorder(), req)
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(bytes.SplitN(buf.Bytes(), []byte("\n"), 2)[0], &entry); err != nil {
+		t.Fatalf("Failed to decode entry %q: %v", buf.String(), err)
+	}
+	assert.Equal(t, "Handler log", entry["msg"])
+	assert.Equal(t, "req-1", entry["request_id"])
+	assert.Equal(t, "/users/:id", entry["route"])
+
+	// Without a middleware, the default logger is returned.
+	assert.Same(t, slog.Default(), middleware.SlogFromContext(context.Background()))
+}
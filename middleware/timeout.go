@@ -4,12 +4,15 @@ import (
 	"context"
 	"net/http"
 	"time"
+
+	"github.com/lab42/httplib"
 )
 
 // TimeoutMiddleware is a middleware that sets a timeout for handling requests.
 type TimeoutMiddleware struct {
 	Next    http.Handler
-	Timeout time.Duration // The maximum duration for request processing.
+	Skipper httplib.Matcher // Skips the middleware for matching requests.
+	Timeout time.Duration   // The maximum duration for request processing.
 }
 
 // NewTimeoutMiddleware creates a new TimeoutMiddleware instance.
@@ -20,8 +23,35 @@ func NewTimeoutMiddleware(next http.Handler, timeout time.Duration) *TimeoutMidd
 	}
 }
 
+// TimeoutOption configures a TimeoutMiddleware.
+type TimeoutOption func(*TimeoutMiddleware)
+
+// WithTimeoutSkipper skips the middleware for requests matching skipper.
+func WithTimeoutSkipper(skipper httplib.Matcher) TimeoutOption {
+	return func(m *TimeoutMiddleware) {
+		m.Skipper = skipper
+	}
+}
+
+// Timeout returns a middleware that sets a timeout for handling requests.
+func Timeout(timeout time.Duration, opts ...TimeoutOption) func(http.Handler) http.Handler {
+	template := NewTimeoutMiddleware(nil, timeout)
+	for _, opt := range opts {
+		opt(template)
+	}
+
+	return chainable(template, func(m *TimeoutMiddleware, next http.Handler) {
+		m.Next = next
+	})
+}
+
 // ServeHTTP is the middleware handler function that enforces the request timeout.
 func (m *TimeoutMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.Skipper != nil && m.Skipper(r) {
+		m.Next.ServeHTTP(w, r)
+		return
+	}
+
 	// Create a context with a timeout.
 	ctx, cancel := context.WithTimeout(r.Context(), m.Timeout)
 	defer cancel()
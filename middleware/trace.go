@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// TraceIDExtractor returns the trace ID of a request, or an empty string when
+// the request is not traced.
+type TraceIDExtractor func(r *http.Request) string
+
+// TraceParentID extracts the trace ID from the W3C traceparent header of
+// sampled requests.
+func TraceParentID(r *http.Request) string {
+	// version "-" trace-id "-" parent-id "-" trace-flags
+	parts := strings.Split(strings.TrimSpace(r.Header.Get("traceparent")), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return ""
+	}
+	traceID, parentID, flags := parts[1], parts[2], parts[3]
+	if len(traceID) != 32 || !isLowerHex(traceID) || strings.Trim(traceID, "0") == "" {
+		return ""
+	}
+	if len(parentID) != 16 || !isLowerHex(parentID) || len(flags) != 2 || !isLowerHex(flags) {
+		return ""
+	}
+
+	// Only sampled traces are recorded by the tracing backend.
+	if f, _ := strconv.ParseUint(flags, 16, 8); f&1 == 0 {
+		return ""
+	}
+	return traceID
+}
+
+// isLowerHex reports whether s only contains lowercase hexadecimal digits.
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
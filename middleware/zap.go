@@ -1,19 +1,23 @@
 package middleware
 
 import (
+	"context"
 	"net/http"
-	"strings"
-	"time"
 
-	"github.com/lab42/httplib/internal"
+	"github.com/lab42/httplib"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
-// ZapMiddleware is a middleware that logs HTTP request information using Zap.
+// ZapMiddleware is a middleware that logs one access-log entry per HTTP
+// request using Zap. Entries are logged at the info level, at the warn level
+// for 4xx responses and at the error level for 5xx responses.
 type ZapMiddleware struct {
-	Next          http.Handler
-	Logger        *zap.Logger
-	SensitiveKeys []string // Sensitive field keys to be obfuscated
+	Next            http.Handler
+	Skipper         httplib.Matcher // Skips the middleware for matching requests.
+	Logger          *zap.Logger
+	SensitiveKeys   []string // Sensitive field keys to be obfuscated
+	AccessLogConfig          // Settings of the access log, shared with the other access-log middlewares.
 }
 
 // NewZapMiddleware creates a new ZapMiddleware instance.
@@ -21,49 +25,121 @@ func NewZapMiddleware(next http.Handler, logger *zap.Logger, sensitiveKeys []str
 	return &ZapMiddleware{Next: next, Logger: logger, SensitiveKeys: sensitiveKeys}
 }
 
+// ZapOption configures a ZapMiddleware.
+type ZapOption func(*ZapMiddleware)
+
+// WithZapSkipper skips the middleware for requests matching skipper.
+func WithZapSkipper(skipper httplib.Matcher) ZapOption {
+	return func(m *ZapMiddleware) {
+		m.Skipper = skipper
+	}
+}
+
+// WithZapSensitiveKeys sets the field keys to be obfuscated.
+func WithZapSensitiveKeys(keys ...string) ZapOption {
+	return func(m *ZapMiddleware) {
+		m.SensitiveKeys = keys
+	}
+}
+
+// WithZapAccessLog configures the access log with opts.
+func WithZapAccessLog(opts ...AccessLogOption) ZapOption {
+	return func(m *ZapMiddleware) {
+		for _, opt := range opts {
+			opt(&m.AccessLogConfig)
+		}
+	}
+}
+
+// Zap returns a middleware that logs HTTP request information using logger.
+func Zap(logger *zap.Logger, opts ...ZapOption) func(http.Handler) http.Handler {
+	template := NewZapMiddleware(nil, logger, nil)
+	for _, opt := range opts {
+		opt(template)
+	}
+
+	return chainable(template, func(m *ZapMiddleware, next http.Handler) {
+		m.Next = next
+	})
+}
+
 // ServeHTTP is the middleware handler function that logs HTTP request information.
 func (m *ZapMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Record the start time to calculate the request duration
-	now := time.Now()
-
-	// Create a Zap logger for logging
-	logger := m.Logger
-
-	// Log query parameters
-	for k, v := range r.URL.Query() {
-		logger.Info("Query parameter",
-			zap.String("key", k),
-			zap.String("value", strings.Join(v, ",")),
-		)
+	if m.Skipper != nil && m.Skipper(r) {
+		m.Next.ServeHTTP(w, r)
+		return
 	}
 
-	// Parse form data and log it
-	r.ParseForm()
-	for k, v := range r.Form {
-		// Obfuscate sensitive data based on configured sensitive keys
-		obfuscatedValues := internal.ObfuscateSensitiveData(k, v, m.SensitiveKeys)
-		logger.Info("Form data",
-			zap.String("key", k),
-			zap.String("value", strings.Join(obfuscatedValues, ",")),
-		)
+	// Make a logger enriched with the request metadata available to handlers,
+	// adding the route when they log
+	route := m.AccessLogConfig.lazyRoute(&r)
+	logger := m.Logger.With(zapFields(m.AccessLogConfig.contextFields(r))...).
+		WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+			return zapRouteCore{core, route}
+		}))
+	r = r.WithContext(context.WithValue(r.Context(), zapContextKey{}, logger))
+
+	entry := m.AccessLogConfig.serve(m.Next, w, r, m.SensitiveKeys)
+
+	// Log a single entry, at a level depending on the response status
+	fields := zapFields(entry.Fields)
+	switch entry.Level {
+	case accessLogError:
+		m.Logger.Error(accessLogMessage, fields...)
+	case accessLogWarn:
+		m.Logger.Warn(accessLogMessage, fields...)
+	default:
+		m.Logger.Info(accessLogMessage, fields...)
+	}
+}
+
+// zapRouteCore is a zapcore.Core adding the route, resolved when an entry is
+// logged, to the entries of the core it wraps.
+type zapRouteCore struct {
+	zapcore.Core
+	route func() string
+}
+
+// With implements zapcore.Core.
+func (c zapRouteCore) With(fields []zapcore.Field) zapcore.Core {
+	return zapRouteCore{c.Core.With(fields), c.route}
+}
+
+// Check implements zapcore.Core, letting the wrapped core enriched with the
+// route decide whether the entry is logged.
+func (c zapRouteCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.Enabled(ent.Level) {
+		return ce
 	}
+	return c.Core.With([]zapcore.Field{zap.String("route", c.route())}).Check(ent, ce)
+}
 
-	// Log request details
-	logger.Info("Request details",
-		zap.String("method", r.Method),
-		zap.String("protocol", r.Proto),
-		zap.String("remote_addr", r.RemoteAddr),
-		zap.String("request_uri", r.RequestURI),
-		zap.String("user_agent", r.UserAgent()),
-		zap.String("referer", r.Referer()),
-	)
-
-	// Call the next handler in the chain
-	m.Next.ServeHTTP(w, r)
-
-	// Calculate and log the request duration in milliseconds
-	duration := time.Since(now).Milliseconds()
-	logger.Info("Request duration",
-		zap.Int64("duration_ms", duration),
-	)
+// zapContextKey is the context key of the request-scoped Zap logger.
+type zapContextKey struct{}
+
+// ZapFromContext returns the request-scoped logger stored in ctx by the
+// ZapMiddleware, or the global zap.L logger when there is none.
+func ZapFromContext(ctx context.Context) *zap.Logger {
+	if logger, ok := ctx.Value(zapContextKey{}).(*zap.Logger); ok {
+		return logger
+	}
+	return zap.L()
+}
+
+// zapFields converts access-log fields to Zap fields.
+func zapFields(fields []accessLogField) []zap.Field {
+	zapFields := make([]zap.Field, 0, len(fields))
+	for _, f := range fields {
+		switch v := f.Value.(type) {
+		case string:
+			zapFields = append(zapFields, zap.String(f.Key, v))
+		case int:
+			zapFields = append(zapFields, zap.Int(f.Key, v))
+		case int64:
+			zapFields = append(zapFields, zap.Int64(f.Key, v))
+		default:
+			zapFields = append(zapFields, zap.Any(f.Key, v))
+		}
+	}
+	return zapFields
 }
@@ -1 +1,233 @@
 package middleware_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/lab42/httplib"
+	"github.com/lab42/httplib/middleware"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestZapMiddleware(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+
+	// Create a handler writing a fixed body.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("Hello, World!"))
+	})
+
+	// Create a ZapMiddleware instance.
+	m := middleware.NewZapMiddleware(handler, zap.New(core), nil)
+
+	// Create a test request.
+	req := httptest.NewRequest(http.MethodPost, "/users/42?password=secret", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("User-Agent", "test-agent")
+	req.Header.Set("X-Request-ID", "req-1")
+
+	// Execute the middleware.
+	m.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Check that a single entry describes the request.
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 log entry, got %d", len(entries))
+	}
+	entry := entries[0]
+	assert.Equal(t, zapcore.InfoLevel, entry.Level)
+	assert.Equal(t, "HTTP request", entry.Message)
+
+	fields := entry.ContextMap()
+	assert.Equal(t, http.MethodPost, fields["method"])
+	assert.Equal(t, "/users/:id", fields["route"])
+	assert.Equal(t, "/users/42", fields["path"])
+	assert.Equal(t, int64(http.StatusCreated), fields["status"])
+	assert.Equal(t, int64(13), fields["bytes"])
+	assert.Contains(t, fields, "duration_ms")
+	assert.Equal(t, "192.0.2.1", fields["remote_ip"])
+	assert.Equal(t, "test-agent", fields["user_agent"])
+	assert.Equal(t, "req-1", fields["request_id"])
+
+	// Parameters are only logged on request.
+	assert.NotContains(t, fields, "params")
+}
+
+func TestZapMiddlewareLevelByStatus(t *testing.T) {
+	tests := map[int]zapcore.Level{
+		http.StatusOK:                  zapcore.InfoLevel,
+		http.StatusFound:               zapcore.InfoLevel,
+		http.StatusNotFound:            zapcore.WarnLevel,
+		http.StatusInternalServerError: zapcore.ErrorLevel,
+	}
+
+	for status, level := range tests {
+		core, logs := observer.New(zapcore.DebugLevel)
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		})
+
+		// Execute the middleware.
+		middleware.Zap(zap.New(core))(handler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+		entries := logs.All()
+		if assert.Len(t, entries, 1) {
+			assert.Equal(t, level, entries[0].Level, "status %d", status)
+		}
+	}
+}
+
+func TestZapMiddlewareParams(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+
+	// Create a handler parsing the form and reading it.
+	var username string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username = r.FormValue("username")
+	})
+
+	// Create a Zap middleware logging obfuscated parameters.
+	m := middleware.Zap(zap.New(core),
+		middleware.WithZapSensitiveKeys("password"),
+		middleware.WithZapAccessLog(
+			middleware.WithAccessLogParams(),
+			middleware.WithAccessLogRequestIDHeader("X-Correlation-ID"),
+		),
+	)(handler)
+
+	// Create a test request with a form body.
+	form := url.Values{"username": {"john"}, "password": {"secret"}}
+	req := httptest.NewRequest(http.MethodPost, "/login?next=/home", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Correlation-ID", "corr-1")
+
+	// Execute the middleware.
+	m.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Check that the body was left to the handler.
+	assert.Equal(t, "john", username)
+
+	fields := logs.All()[0].ContextMap()
+	assert.Equal(t, "corr-1", fields["request_id"])
+	assert.Equal(t, map[string]string{
+		"next":     "/home",
+		"username": "john",
+		"password": "********",
+	}, fields["params"])
+}
+
+func TestZapMiddlewareRedactor(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+
+	// Create a Zap middleware hashing sensitive values, so that they can be joined.
+	redactor := httplib.NewRedactor("user_id")
+	redactor.Mask = httplib.MaskHMAC([]byte("key"))
+	m := middleware.Zap(zap.New(core),
+		middleware.WithZapAccessLog(
+			middleware.WithAccessLogParams(),
+			middleware.WithAccessLogHeaders(),
+			middleware.WithAccessLogRedactor(redactor),
+		),
+	)(http.NotFoundHandler())
+
+	// Execute the middleware twice with the same user.
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/?user_id=42", nil)
+		req.Header.Set("X-Request-ID", "req-1")
+		m.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	first := logs.All()[0].ContextMap()
+	second := logs.All()[1].ContextMap()
+	hashed := first["params"].(map[string]string)["user_id"]
+	assert.Equal(t, redactor.Mask("42"), hashed)
+	assert.Equal(t, first["params"], second["params"])
+	assert.Equal(t, map[string]string{"X-Request-Id": "req-1"}, first["headers"])
+	assert.Equal(t, map[string]string{}, first["cookies"])
+}
+
+func TestZapMiddlewareLiteral(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+
+	// Create a ZapMiddleware as a composite literal, logging parameters.
+	m := &middleware.ZapMiddleware{Next: http.NotFoundHandler(), Logger: zap.New(core), SensitiveKeys: []string{"pin"}}
+	m.LogParams = true
+
+	// Execute the middleware.
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?pin=1234&page=2", nil))
+
+	fields := logs.All()[0].ContextMap()
+	assert.Equal(t, map[string]string{"pin": "********", "page": "2"}, fields["params"])
+}
+
+func TestZapFromContext(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+
+	// Create a handler logging with the request-scoped logger.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		middleware.ZapFromContext(r.Context()).Info("Handler log")
+	})
+
+	// Create a test request.
+	req := httptest.NewRequest(http.MethodGet, "/users/42", nil)
+	req.Header.Set("X-Request-ID", "req-1")
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	// Execute the middleware.
+	middleware.Zap(zap.New(core))(handler).ServeHTTP(httptest.NewRecorder(), req)
+
+	// Check that the handler log carries the request metadata of the access log.
+	entries := logs.All()
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 log entries, got %d", len(entries))
+	}
+	handlerFields, accessFields := entries[0].ContextMap(), entries[1].ContextMap()
+	assert.Equal(t, "Handler log", entries[0].Message)
+	for _, key := range []string{"request_id", "method", "route", "trace_id"} {
+		assert.Equal(t, accessFields[key], handlerFields[key], key)
+	}
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", handlerFields["trace_id"])
+
+	// Without a middleware, the global logger is returned.
+	assert.Same(t, zap.L(), middleware.ZapFromContext(context.Background()))
+}
+
+func TestZapMiddlewareTraceID(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+
+	// Create a handler logging with the request-scoped logger.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		middleware.ZapFromContext(r.Context()).Info("Handler log")
+	})
+
+	// Create a Zap middleware extracting the trace ID from a custom header.
+	m := middleware.Zap(zap.New(core), middleware.WithZapAccessLog(
+		middleware.WithAccessLogTraceID(func(r *http.Request) string {
+			return r.Header.Get("X-Trace-ID")
+		}),
+	))(handler)
+
+	// Create a test request.
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Trace-ID", "trace-1")
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	// Execute the middleware.
+	m.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Check that both logs carry the extracted trace ID.
+	entries := logs.All()
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 log entries, got %d", len(entries))
+	}
+	assert.Equal(t, "trace-1", entries[0].ContextMap()["trace_id"])
+	assert.Equal(t, "trace-1", entries[1].ContextMap()["trace_id"])
+}
@@ -1,58 +1,143 @@
 package middleware
 
 import (
+	"context"
 	"net/http"
-	"strings"
-	"time"
 
-	"github.com/lab42/httplib/internal"
+	"github.com/lab42/httplib"
+	"github.com/rs/zerolog"
 	log "github.com/rs/zerolog/log"
 )
 
-// ZeroLogMiddleware is a middleware that logs HTTP request information using ZeroLog.
+// ZeroLogMiddleware is a middleware that logs one access-log event per HTTP
+// request using ZeroLog. Events are logged at the info level, at the warn
+// level for 4xx responses and at the error level for 5xx responses.
 type ZeroLogMiddleware struct {
-	Next          http.Handler
-	SensitiveKeys []string // Sensitive field keys to be obfuscated
+	Next            http.Handler
+	Skipper         httplib.Matcher // Skips the middleware for matching requests.
+	Logger          *zerolog.Logger // Logger the events are written to. Defaults to the global logger.
+	Sampler         zerolog.Sampler // Samples the logged events. All events are logged when nil.
+	SensitiveKeys   []string        // Sensitive field keys to be obfuscated
+	AccessLogConfig                 // Settings of the access log, shared with the other access-log middlewares.
 }
 
-// NewZeroLogMiddleware creates a new ZeroLogMiddleware instance.
+// NewZeroLogMiddleware creates a new ZeroLogMiddleware instance logging to
+// the global zerolog logger.
 func NewZeroLogMiddleware(next http.Handler, sensitiveKeys []string) *ZeroLogMiddleware {
 	return &ZeroLogMiddleware{Next: next, SensitiveKeys: sensitiveKeys}
 }
 
+// ZeroLogOption configures a ZeroLogMiddleware.
+type ZeroLogOption func(*ZeroLogMiddleware)
+
+// WithZeroLogSkipper skips the middleware for requests matching skipper.
+func WithZeroLogSkipper(skipper httplib.Matcher) ZeroLogOption {
+	return func(m *ZeroLogMiddleware) {
+		m.Skipper = skipper
+	}
+}
+
+// WithZeroLogSensitiveKeys sets the field keys to be obfuscated.
+func WithZeroLogSensitiveKeys(keys ...string) ZeroLogOption {
+	return func(m *ZeroLogMiddleware) {
+		m.SensitiveKeys = keys
+	}
+}
+
+// WithZeroLogLogger sets the logger the events are written to.
+func WithZeroLogLogger(logger zerolog.Logger) ZeroLogOption {
+	return func(m *ZeroLogMiddleware) {
+		m.Logger = &logger
+	}
+}
+
+// WithZeroLogSampler samples the logged events with sampler, such as a
+// zerolog.BasicSampler or a zerolog.LevelSampler.
+func WithZeroLogSampler(sampler zerolog.Sampler) ZeroLogOption {
+	return func(m *ZeroLogMiddleware) {
+		m.Sampler = sampler
+	}
+}
+
+// WithZeroLogAccessLog configures the access log with opts.
+func WithZeroLogAccessLog(opts ...AccessLogOption) ZeroLogOption {
+	return func(m *ZeroLogMiddleware) {
+		for _, opt := range opts {
+			opt(&m.AccessLogConfig)
+		}
+	}
+}
+
+// ZeroLog returns a middleware that logs HTTP request information using ZeroLog.
+func ZeroLog(opts ...ZeroLogOption) func(http.Handler) http.Handler {
+	template := NewZeroLogMiddleware(nil, nil)
+	for _, opt := range opts {
+		opt(template)
+	}
+
+	return chainable(template, func(m *ZeroLogMiddleware, next http.Handler) {
+		m.Next = next
+	})
+}
+
 // ServeHTTP is the middleware handler function that logs HTTP request information.
 func (m *ZeroLogMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Record the start time to calculate the request duration
-	now := time.Now()
+	if m.Skipper != nil && m.Skipper(r) {
+		m.Next.ServeHTTP(w, r)
+		return
+	}
 
-	// Create a ZeroLog event for logging
-	event := log.Info()
+	// Log to the global logger unless one was injected
+	logger := log.Logger
+	if m.Logger != nil {
+		logger = *m.Logger
+	}
+
+	// Make a logger enriched with the request metadata available to handlers,
+	// adding the route when they log
+	route := m.AccessLogConfig.lazyRoute(&r)
+	contextLogger := logger.With().Fields(zerologFields(m.AccessLogConfig.contextFields(r))).Logger().
+		Hook(zerolog.HookFunc(func(e *zerolog.Event, _ zerolog.Level, _ string) {
+			e.Str("route", route())
+		}))
+	r = r.WithContext(contextLogger.WithContext(r.Context()))
 
-	// Log query parameters
-	for k, v := range r.URL.Query() {
-		event.Str("query_"+k, strings.Join(v, ","))
+	entry := m.AccessLogConfig.serve(m.Next, w, r, m.SensitiveKeys)
+
+	if m.Sampler != nil {
+		logger = logger.Sample(m.Sampler)
 	}
 
-	// Parse form data and log it
-	r.ParseForm()
-	for k, v := range r.Form {
-		// Obfuscate sensitive data based on configured sensitive keys
-		obfuscatedValues := internal.ObfuscateSensitiveData(k, v, m.SensitiveKeys)
-		event.Str("form_"+k, strings.Join(obfuscatedValues, ","))
+	// Create a ZeroLog event at a level depending on the response status
+	var event *zerolog.Event
+	switch entry.Level {
+	case accessLogError:
+		event = logger.Error()
+	case accessLogWarn:
+		event = logger.Warn()
+	default:
+		event = logger.Info()
+	}
+	if event == nil {
+		// The event is disabled or sampled out.
+		return
 	}
 
-	// Log request details
-	event.Str("method", r.Method)
-	event.Str("protocol", r.Proto)
-	event.Str("remote_addr", r.RemoteAddr)
-	event.Str("request_uri", r.RequestURI)
-	event.Str("user_agent", r.UserAgent())
-	event.Str("referer", r.Referer())
+	event.Fields(zerologFields(entry.Fields)).Msg(accessLogMessage)
+}
 
-	// Call the next handler in the chain
-	m.Next.ServeHTTP(w, r)
+// ZeroLogFromContext returns the request-scoped logger stored in ctx by the
+// ZeroLogMiddleware, or zerolog.DefaultContextLogger, or a disabled logger
+// when there is none. It is equivalent to zerolog.Ctx.
+func ZeroLogFromContext(ctx context.Context) *zerolog.Logger {
+	return zerolog.Ctx(ctx)
+}
 
-	// Calculate and log the request duration in milliseconds
-	duration := time.Since(now).Milliseconds()
-	event.Int64("duration_ms", duration)
+// zerologFields converts access-log fields to a list of ZeroLog fields.
+func zerologFields(fields []accessLogField) []interface{} {
+	list := make([]interface{}, 0, 2*len(fields))
+	for _, f := range fields {
+		list = append(list, f.Key, f.Value)
+	}
+	return list
 }
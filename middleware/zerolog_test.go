@@ -1 +1,251 @@
 package middleware_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lab42/httplib"
+	"github.com/lab42/httplib/internal"
+	"github.com/lab42/httplib/middleware"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// zerologEvents decodes the JSON events written to buf.
+func zerologEvents(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+
+	var events []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("Failed to decode event %q: %v", line, err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestZeroLogMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+
+	// Create a handler writing a fixed body.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("Hello, World!"))
+	})
+
+	// Create a ZeroLog middleware with an injected logger.
+	m := middleware.ZeroLog(middleware.WithZeroLogLogger(zerolog.New(&buf)))(handler)
+
+	// Create a test request.
+	req := httptest.NewRequest(http.MethodPost, "/users/42", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("User-Agent", "test-agent")
+	req.Header.Set("X-Request-ID", "req-1")
+
+	// Execute the middleware.
+	m.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Check that a single event describes the request.
+	events := zerologEvents(t, &buf)
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(events))
+	}
+	event := events[0]
+	assert.Equal(t, "info", event["level"])
+	assert.Equal(t, "HTTP request", event["message"])
+	assert.Equal(t, http.MethodPost, event["method"])
+	assert.Equal(t, "/users/:id", event["route"])
+	assert.Equal(t, "/users/42", event["path"])
+	assert.Equal(t, float64(http.StatusCreated), event["status"])
+	assert.Equal(t, float64(13), event["bytes"])
+	assert.Contains(t, event, "duration_ms")
+	assert.Equal(t, "192.0.2.1", event["remote_ip"])
+	assert.Equal(t, "test-agent", event["user_agent"])
+	assert.Equal(t, "req-1", event["request_id"])
+	assert.NotContains(t, event, "params")
+}
+
+func TestZeroLogMiddlewareLevelByStatus(t *testing.T) {
+	tests := map[int]string{
+		http.StatusOK:                  "info",
+		http.StatusNotFound:            "warn",
+		http.StatusInternalServerError: "error",
+	}
+
+	for status, level := range tests {
+		var buf bytes.Buffer
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		})
+
+		// Execute the middleware.
+		m := middleware.NewZeroLogMiddleware(handler, nil)
+		logger := zerolog.New(&buf)
+		m.Logger = &logger
+		m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+		events := zerologEvents(t, &buf)
+		if assert.Len(t, events, 1) {
+			assert.Equal(t, level, events[0]["level"], "status %d", status)
+		}
+	}
+}
+
+func TestZeroLogMiddlewareGlobalLogger(t *testing.T) {
+	var buf bytes.Buffer
+
+	// Replace the global logger for the duration of the test.
+	global := log.Logger
+	log.Logger = zerolog.New(&buf)
+	defer func() { log.Logger = global }()
+
+	// Create a ZeroLogMiddleware without logger.
+	m := &middleware.ZeroLogMiddleware{Next: http.HandlerFunc(internal.DummyHandler)}
+
+	// Execute the middleware.
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	// Check that the event was logged to the global logger.
+	events := zerologEvents(t, &buf)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "HTTP request", events[0]["message"])
+	}
+}
+
+func TestZeroLogMiddlewareSampler(t *testing.T) {
+	var buf bytes.Buffer
+
+	// Create a ZeroLog middleware logging one request out of three.
+	m := middleware.ZeroLog(
+		middleware.WithZeroLogLogger(zerolog.New(&buf)),
+		middleware.WithZeroLogSampler(&zerolog.BasicSampler{N: 3}),
+	)(http.NotFoundHandler())
+
+	// Execute the middleware.
+	for i := 0; i < 6; i++ {
+		m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	assert.Len(t, zerologEvents(t, &buf), 2)
+}
+
+func TestZeroLogMiddlewareParams(t *testing.T) {
+	var buf bytes.Buffer
+
+	// Create a ZeroLog middleware logging obfuscated parameters.
+	m := middleware.ZeroLog(
+		middleware.WithZeroLogLogger(zerolog.New(&buf)),
+		middleware.WithZeroLogAccessLog(middleware.WithAccessLogParams()),
+		middleware.WithZeroLogSensitiveKeys("token"),
+	)(http.NotFoundHandler())
+
+	// Execute the middleware.
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?token=secret&page=2", nil))
+
+	events := zerologEvents(t, &buf)
+	assert.Equal(t, map[string]interface{}{"token": "********", "page": "2"}, events[0]["params"])
+}
+
+// dropSampler is a zerolog sampler dropping every event.
+type dropSampler struct{}
+
+func (dropSampler) Sample(zerolog.Level) bool {
+	return false
+}
+
+func TestZeroLogFromContext(t *testing.T) {
+	var buf bytes.Buffer
+
+	// Create a handler logging with the request-scoped logger.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		middleware.ZeroLogFromContext(r.Context()).Info().Msg("Handler log")
+	})
+
+	// Create a test request.
+	req := httptest.NewRequest(http.MethodGet, "/users/42", nil)
+	req.Header.Set("X-Request-ID", "req-1")
+
+	// Execute the middleware, sampling out every access event.
+	m := middleware.ZeroLog(
+		middleware.WithZeroLogLogger(zerolog.New(&buf)),
+		middleware.WithZeroLogSampler(dropSampler{}),
+	)(handler)
+	m.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Check that the handler log carries the request metadata and is not sampled.
+	events := zerologEvents(t, &buf)
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(events))
+	}
+	assert.Equal(t, "Handler log", events[0]["message"])
+	assert.Equal(t, "req-1", events[0]["request_id"])
+	assert.Equal(t, http.MethodGet, events[0]["method"])
+	assert.Equal(t, "/users/:id", events[0]["route"])
+	assert.Equal(t, "", events[0]["trace_id"])
+}
+
+func TestZeroLogMiddlewareHeaders(t *testing.T) {
+	var buf bytes.Buffer
+
+	// Create a ZeroLog middleware logging redacted parameters and headers.
+	m := middleware.ZeroLog(
+		middleware.WithZeroLogLogger(zerolog.New(&buf)),
+		middleware.WithZeroLogAccessLog(
+			middleware.WithAccessLogParams(),
+			middleware.WithAccessLogHeaders(),
+			middleware.WithAccessLogRedactor(httplib.NewRedactor("*token*", "session")),
+		),
+	)(http.NotFoundHandler())
+
+	// Create a test request.
+	req := httptest.NewRequest(http.MethodGet, "/?access_token=secret&email=john@example.com&page=2", nil)
+	req.Header.Set("Authorization", "Bearer abc")
+	req.Header.Set("Accept", "text/html")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "s3cr3t"})
+
+	// Execute the middleware.
+	m.ServeHTTP(httptest.NewRecorder(), req)
+
+	events := zerologEvents(t, &buf)
+	assert.Equal(t, map[string]interface{}{"access_token": "********", "email": "********", "page": "2"}, events[0]["params"])
+	assert.Equal(t, map[string]interface{}{"Authorization": "********", "Accept": "text/html"}, events[0]["headers"])
+	assert.Equal(t, map[string]interface{}{"session": "********"}, events[0]["cookies"])
+}
+
+func TestZeroLogMiddlewareDefaultRedaction(t *testing.T) {
+	var buf bytes.Buffer
+
+	// Create a ZeroLog middleware logging headers without any sensitive key.
+	m := middleware.ZeroLog(
+		middleware.WithZeroLogLogger(zerolog.New(&buf)),
+		middleware.WithZeroLogAccessLog(middleware.WithAccessLogParams(), middleware.WithAccessLogHeaders()),
+	)(http.NotFoundHandler())
+
+	// Create a test request carrying credentials.
+	req := httptest.NewRequest(http.MethodGet, "/?api_key=key-secret&page=2", nil)
+	req.Header.Set("Authorization", "Basic am9objpzZWNyZXQ=")
+	req.Header.Set("Proxy-Authorization", "Bearer proxy-secret")
+	req.Header.Set("X-Api-Key", "api-secret")
+	req.Header.Set("X-Auth-Token", "token-secret")
+	req.AddCookie(&http.Cookie{Name: "sid", Value: "cookie-secret"})
+
+	// Execute the middleware.
+	m.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Check that no secret is logged.
+	for _, secret := range []string{"am9objpzZWNyZXQ=", "proxy-secret", "api-secret", "token-secret", "cookie-secret", "key-secret"} {
+		assert.NotContains(t, buf.String(), secret)
+	}
+	events := zerologEvents(t, &buf)
+	assert.Equal(t, "2", events[0]["params"].(map[string]interface{})["page"])
+}
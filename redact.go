@@ -0,0 +1,319 @@
+package httplib
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/lab42/httplib/internal"
+)
+
+// Redacted replaces sensitive values masked with MaskAll.
+const Redacted = "********"
+
+// Detector reports whether a value is sensitive, whatever its key.
+type Detector func(value string) bool
+
+// MaskFunc returns the masked form of a sensitive value.
+type MaskFunc func(value string) string
+
+// Redactor masks sensitive values in logged request data: query and form
+// parameters, headers, cookies and JSON bodies. A value is sensitive when
+// its key matches Keys or KeyPatterns, or when one of the Detectors
+// recognizes it. Cookie values are all masked unless LogCookieValues is set.
+type Redactor struct {
+	Keys            []string         // Sensitive keys, compared case-insensitively. Globs such as "*token*" are supported.
+	KeyPatterns     []*regexp.Regexp // Regular expressions matching sensitive keys.
+	Detectors       []Detector       // Detectors of sensitive values, applied to every value.
+	Mask            MaskFunc         // Masks sensitive values. Defaults to MaskAll.
+	LogCookieValues bool             // Logs the values of the cookies that are not sensitive.
+}
+
+// DefaultSensitiveKeys are the sensitive keys of every Redactor created with
+// NewRedactor: credential headers and the keys naming tokens, keys, secrets
+// and passwords.
+var DefaultSensitiveKeys = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"*token*",
+	"*key*",
+	"*secret*",
+	"*password*",
+}
+
+// NewRedactor creates a new Redactor instance masking the values of keys and
+// DefaultSensitiveKeys, and the values recognized by DefaultDetectors.
+func NewRedactor(keys ...string) *Redactor {
+	return &Redactor{
+		Keys:      append(append([]string(nil), DefaultSensitiveKeys...), keys...),
+		Detectors: DefaultDetectors,
+		Mask:      MaskAll,
+	}
+}
+
+// IsSensitiveKey reports whether the values of key are sensitive.
+func (rd *Redactor) IsSensitiveKey(key string) bool {
+	if internal.IsSensitiveField(key, rd.Keys) {
+		return true
+	}
+	for _, pattern := range rd.KeyPatterns {
+		if pattern.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSensitiveValue reports whether one of the detectors recognizes value.
+func (rd *Redactor) IsSensitiveValue(value string) bool {
+	for _, detect := range rd.Detectors {
+		if detect(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Value returns value, masked when it is sensitive.
+func (rd *Redactor) Value(key, value string) string {
+	if rd.IsSensitiveKey(key) || rd.IsSensitiveValue(value) {
+		return rd.mask(value)
+	}
+	return value
+}
+
+// Values returns the values of params joined with commas, sensitive values
+// masked.
+func (rd *Redactor) Values(params url.Values) map[string]string {
+	redacted := make(map[string]string, len(params))
+	for key, values := range params {
+		masked := make([]string, len(values))
+		for i, value := range values {
+			masked[i] = rd.Value(key, value)
+		}
+		redacted[key] = strings.Join(masked, ",")
+	}
+	return redacted
+}
+
+// Header returns the values of header joined with commas, sensitive values
+// masked. Cookies are left out, use Cookies to log them.
+func (rd *Redactor) Header(header http.Header) map[string]string {
+	redacted := make(map[string]string, len(header))
+	for key, values := range header {
+		if key == "Cookie" || key == "Set-Cookie" {
+			continue
+		}
+		masked := make([]string, len(values))
+		for i, value := range values {
+			masked[i] = rd.Value(key, value)
+		}
+		redacted[key] = strings.Join(masked, ",")
+	}
+	return redacted
+}
+
+// Cookies returns the values of cookies by name, masked unless
+// LogCookieValues is set and they are not sensitive.
+func (rd *Redactor) Cookies(cookies []*http.Cookie) map[string]string {
+	redacted := make(map[string]string, len(cookies))
+	for _, cookie := range cookies {
+		if rd.LogCookieValues {
+			redacted[cookie.Name] = rd.Value(cookie.Name, cookie.Value)
+		} else {
+			redacted[cookie.Name] = rd.mask(cookie.Value)
+		}
+	}
+	return redacted
+}
+
+// Text returns text with its sensitive parts masked: the values of the
+// "key: value" and "key=value" pairs with sensitive keys, and the words, word
+// pairs and card numbers recognized by the detectors.
+func (rd *Redactor) Text(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = rd.redactLine(line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+var (
+	textPairPattern = regexp.MustCompile(`^(\s*)([^\s:=]+)(\s*[:=]\s*)(.+)$`)
+	textCardPattern = regexp.MustCompile(`\d(?:[ -]?\d){12,18}`)
+	textWordPattern = regexp.MustCompile(`\S+`)
+)
+
+// redactLine masks the sensitive parts of a line of text.
+func (rd *Redactor) redactLine(line string) string {
+	// A line holding a sensitive pair is masked after the key.
+	if m := textPairPattern.FindStringSubmatch(line); m != nil && rd.IsSensitiveKey(m[2]) {
+		return m[1] + m[2] + m[3] + rd.mask(m[4])
+	}
+
+	// Card numbers may be grouped in several words.
+	line = textCardPattern.ReplaceAllStringFunc(line, func(number string) string {
+		if rd.IsSensitiveValue(number) {
+			return rd.mask(number)
+		}
+		return number
+	})
+
+	var previous string
+	return textWordPattern.ReplaceAllStringFunc(line, func(word string) string {
+		defer func() { previous = word }()
+
+		// Credentials such as "Bearer <token>" span two words.
+		if previous != "" && rd.IsSensitiveValue(previous+" "+word) {
+			return rd.mask(word)
+		}
+		if key, value, ok := strings.Cut(word, "="); ok && value != "" && rd.IsSensitiveKey(key) {
+			return key + "=" + rd.mask(value)
+		}
+		if core := strings.Trim(word, `.,;:!?()[]{}<>"'`); core != "" && rd.IsSensitiveValue(core) {
+			return strings.Replace(word, core, rd.mask(core), 1)
+		}
+		return word
+	})
+}
+
+// JSON returns the JSON document data with the values of sensitive keys,
+// at any depth, and the sensitive strings masked. It returns an error when
+// data is not valid JSON.
+func (rd *Redactor) JSON(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+	return json.Marshal(rd.redactJSON("", document))
+}
+
+// redactJSON masks the sensitive values of the decoded JSON value v, held by key.
+func (rd *Redactor) redactJSON(key string, v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			v[k] = rd.redactJSON(k, child)
+		}
+		return v
+	case []interface{}:
+		for i, child := range v {
+			v[i] = rd.redactJSON(key, child)
+		}
+		return v
+	case string:
+		return rd.Value(key, v)
+	case json.Number:
+		if rd.IsSensitiveKey(key) || rd.IsSensitiveValue(v.String()) {
+			return rd.mask(v.String())
+		}
+		return v
+	default:
+		if v != nil && rd.IsSensitiveKey(key) {
+			return Redacted
+		}
+		return v
+	}
+}
+
+func (rd *Redactor) mask(value string) string {
+	if rd.Mask == nil {
+		return MaskAll(value)
+	}
+	return rd.Mask(value)
+}
+
+// MaskAll masks the whole value.
+func MaskAll(string) string {
+	return Redacted
+}
+
+// MaskPartial masks all but the last keep characters of values, such as the
+// last 4 digits of a card number. Values not longer than keep are fully masked.
+func MaskPartial(keep int) MaskFunc {
+	return func(value string) string {
+		runes := []rune(value)
+		if len(runes) <= keep {
+			return Redacted
+		}
+		return strings.Repeat("*", len(runes)-keep) + string(runes[len(runes)-keep:])
+	}
+}
+
+// MaskHMAC replaces values by their HMAC-SHA256 keyed with key, so that
+// requests carrying the same value can be joined without revealing it.
+func MaskHMAC(key []byte) MaskFunc {
+	return func(value string) string {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(value))
+		return "hmac:" + hex.EncodeToString(mac.Sum(nil)[:16])
+	}
+}
+
+// DefaultDetectors are the detectors used by NewRedactor.
+var DefaultDetectors = []Detector{DetectCreditCard, DetectJWT, DetectBearerToken, DetectEmail}
+
+var (
+	jwtPattern    = regexp.MustCompile(`^eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*$`)
+	bearerPattern = regexp.MustCompile(`(?i)^bearer\s+\S+$`)
+	emailPattern  = regexp.MustCompile(`^[^\s@]+@[^\s@]+\.[^\s@]+$`)
+)
+
+// DetectCreditCard recognizes payment card numbers: 13 to 19 digits,
+// optionally grouped with spaces or dashes, passing the Luhn check.
+func DetectCreditCard(value string) bool {
+	var digits []byte
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c >= '0' && c <= '9':
+			digits = append(digits, c-'0')
+		case c == ' ' || c == '-':
+		default:
+			return false
+		}
+	}
+	if len(digits) < 13 || len(digits) > 19 {
+		return false
+	}
+
+	// Luhn check: double every second digit from the right.
+	sum := 0
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i])
+		if (len(digits)-i)%2 == 0 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// DetectJWT recognizes JSON Web Tokens.
+func DetectJWT(value string) bool {
+	return jwtPattern.MatchString(strings.TrimSpace(value))
+}
+
+// DetectBearerToken recognizes bearer credentials, such as the value of an
+// Authorization header.
+func DetectBearerToken(value string) bool {
+	return bearerPattern.MatchString(strings.TrimSpace(value))
+}
+
+// DetectEmail recognizes email addresses.
+func DetectEmail(value string) bool {
+	return emailPattern.MatchString(strings.TrimSpace(value))
+}
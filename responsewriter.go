@@ -0,0 +1,302 @@
+package httplib
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ResponseWriter is an http.ResponseWriter that records the status code, the
+// number of bytes written and the timing of a response.
+//
+// The writer returned by NewResponseWriter implements http.Flusher,
+// http.Hijacker, http.Pusher and io.ReaderFrom only when the wrapped writer
+// does, and can be unwrapped by http.ResponseController.
+type ResponseWriter interface {
+	http.ResponseWriter
+
+	// Status returns the status code of the response, http.StatusOK if the
+	// header was not written explicitly.
+	Status() int
+	// BytesWritten returns the number of body bytes written.
+	BytesWritten() int64
+	// HeaderWritten reports whether the header was written.
+	HeaderWritten() bool
+	// HeaderWrittenAt returns when the header was written.
+	HeaderWrittenAt() time.Time
+	// TimeToFirstByte returns the time between the creation of the writer and
+	// the first body byte written, zero if no body was written.
+	TimeToFirstByte() time.Duration
+	// Unwrap returns the wrapped writer.
+	Unwrap() http.ResponseWriter
+}
+
+// responseWriter is the base implementation of ResponseWriter.
+type responseWriter struct {
+	w               http.ResponseWriter
+	start           time.Time
+	status          int
+	bytes           int64
+	headerWrittenAt time.Time
+	firstByteAt     time.Time
+	hijacked        bool
+	tee             io.Writer
+}
+
+// NewResponseWriter wraps w in a ResponseWriter.
+func NewResponseWriter(w http.ResponseWriter) ResponseWriter {
+	return NewTeeResponseWriter(w, nil)
+}
+
+// NewTeeResponseWriter wraps w in a ResponseWriter that also writes the body
+// bytes written to w to tee, such as a buffer capturing the response body.
+// Errors of tee are ignored.
+func NewTeeResponseWriter(w http.ResponseWriter, tee io.Writer) ResponseWriter {
+	rw := &responseWriter{w: w, start: time.Now(), status: http.StatusOK, tee: tee}
+	return WithOptionalInterfaces(rw, w, OptionalInterfaces{
+		Flusher:    flusher{rw},
+		Hijacker:   hijacker{rw},
+		Pusher:     pusher{rw},
+		ReaderFrom: readerFrom{rw},
+	})
+}
+
+// OptionalInterfaces are the implementations of the optional interfaces of
+// http.ResponseWriter by a writer wrapping another one.
+type OptionalInterfaces struct {
+	Flusher    http.Flusher
+	Hijacker   http.Hijacker
+	Pusher     http.Pusher
+	ReaderFrom io.ReaderFrom
+}
+
+// WithOptionalInterfaces returns rw extended with the implementations of opt
+// whose interface is implemented by wrapped, the writer rw wraps. A writer
+// wrapping another one thus never exposes an optional interface the wrapped
+// writer lacks, and callers type-asserting it fall back correctly.
+func WithOptionalInterfaces(rw ResponseWriter, wrapped http.ResponseWriter, opt OptionalInterfaces) ResponseWriter {
+	_, isFlusher := wrapped.(http.Flusher)
+	_, isHijacker := wrapped.(http.Hijacker)
+	_, isPusher := wrapped.(http.Pusher)
+	_, isReaderFrom := wrapped.(io.ReaderFrom)
+	isFlusher = isFlusher && opt.Flusher != nil
+	isHijacker = isHijacker && opt.Hijacker != nil
+	isPusher = isPusher && opt.Pusher != nil
+	isReaderFrom = isReaderFrom && opt.ReaderFrom != nil
+
+	f, h, p, rf := opt.Flusher, opt.Hijacker, opt.Pusher, opt.ReaderFrom
+	switch {
+	case isFlusher && isHijacker && isPusher && isReaderFrom:
+		return struct {
+			ResponseWriter
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+			io.ReaderFrom
+		}{rw, f, h, p, rf}
+	case isFlusher && isHijacker && isPusher:
+		return struct {
+			ResponseWriter
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{rw, f, h, p}
+	case isFlusher && isHijacker && isReaderFrom:
+		return struct {
+			ResponseWriter
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{rw, f, h, rf}
+	case isFlusher && isPusher && isReaderFrom:
+		return struct {
+			ResponseWriter
+			http.Flusher
+			http.Pusher
+			io.ReaderFrom
+		}{rw, f, p, rf}
+	case isHijacker && isPusher && isReaderFrom:
+		return struct {
+			ResponseWriter
+			http.Hijacker
+			http.Pusher
+			io.ReaderFrom
+		}{rw, h, p, rf}
+	case isFlusher && isHijacker:
+		return struct {
+			ResponseWriter
+			http.Flusher
+			http.Hijacker
+		}{rw, f, h}
+	case isFlusher && isPusher:
+		return struct {
+			ResponseWriter
+			http.Flusher
+			http.Pusher
+		}{rw, f, p}
+	case isFlusher && isReaderFrom:
+		return struct {
+			ResponseWriter
+			http.Flusher
+			io.ReaderFrom
+		}{rw, f, rf}
+	case isHijacker && isPusher:
+		return struct {
+			ResponseWriter
+			http.Hijacker
+			http.Pusher
+		}{rw, h, p}
+	case isHijacker && isReaderFrom:
+		return struct {
+			ResponseWriter
+			http.Hijacker
+			io.ReaderFrom
+		}{rw, h, rf}
+	case isPusher && isReaderFrom:
+		return struct {
+			ResponseWriter
+			http.Pusher
+			io.ReaderFrom
+		}{rw, p, rf}
+	case isFlusher:
+		return struct {
+			ResponseWriter
+			http.Flusher
+		}{rw, f}
+	case isHijacker:
+		return struct {
+			ResponseWriter
+			http.Hijacker
+		}{rw, h}
+	case isPusher:
+		return struct {
+			ResponseWriter
+			http.Pusher
+		}{rw, p}
+	case isReaderFrom:
+		return struct {
+			ResponseWriter
+			io.ReaderFrom
+		}{rw, rf}
+	default:
+		return rw
+	}
+}
+
+// Header implements http.ResponseWriter.
+func (rw *responseWriter) Header() http.Header {
+	return rw.w.Header()
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (rw *responseWriter) WriteHeader(code int) {
+	// Informational responses may precede the final status code.
+	if !rw.HeaderWritten() && code >= 200 {
+		rw.status = code
+		rw.headerWrittenAt = time.Now()
+	}
+	rw.w.WriteHeader(code)
+}
+
+// Write implements http.ResponseWriter.
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	rw.markWritten(len(b))
+	n, err := rw.w.Write(b)
+	rw.bytes += int64(n)
+	if rw.tee != nil && n > 0 {
+		rw.tee.Write(b[:n])
+	}
+	return n, err
+}
+
+// markWritten records the implicit header and the first body byte of a write of n bytes.
+func (rw *responseWriter) markWritten(n int) {
+	now := time.Now()
+	if !rw.HeaderWritten() {
+		rw.headerWrittenAt = now
+	}
+	if n > 0 && rw.firstByteAt.IsZero() {
+		rw.firstByteAt = now
+	}
+}
+
+func (rw *responseWriter) Status() int {
+	return rw.status
+}
+
+func (rw *responseWriter) BytesWritten() int64 {
+	return rw.bytes
+}
+
+func (rw *responseWriter) HeaderWritten() bool {
+	return !rw.headerWrittenAt.IsZero() || rw.hijacked
+}
+
+func (rw *responseWriter) HeaderWrittenAt() time.Time {
+	return rw.headerWrittenAt
+}
+
+func (rw *responseWriter) TimeToFirstByte() time.Duration {
+	if rw.firstByteAt.IsZero() {
+		return 0
+	}
+	return rw.firstByteAt.Sub(rw.start)
+}
+
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.w
+}
+
+// flusher implements http.Flusher for a responseWriter.
+type flusher struct {
+	*responseWriter
+}
+
+func (f flusher) Flush() {
+	f.markWritten(0)
+	f.w.(http.Flusher).Flush()
+}
+
+// hijacker implements http.Hijacker for a responseWriter.
+type hijacker struct {
+	*responseWriter
+}
+
+func (h hijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := h.w.(http.Hijacker).Hijack()
+	if err == nil && !h.HeaderWritten() {
+		// The handler takes over the connection, typically to switch protocols.
+		h.status = http.StatusSwitchingProtocols
+		h.hijacked = true
+	}
+	return conn, brw, err
+}
+
+// pusher implements http.Pusher for a responseWriter.
+type pusher struct {
+	*responseWriter
+}
+
+func (p pusher) Push(target string, opts *http.PushOptions) error {
+	return p.w.(http.Pusher).Push(target, opts)
+}
+
+// readerFrom implements io.ReaderFrom for a responseWriter.
+type readerFrom struct {
+	*responseWriter
+}
+
+func (rf readerFrom) ReadFrom(src io.Reader) (int64, error) {
+	rf.markWritten(0)
+	if rf.tee != nil {
+		src = io.TeeReader(src, rf.tee)
+	}
+	n, err := rf.w.(io.ReaderFrom).ReadFrom(src)
+	if n > 0 && rf.firstByteAt.IsZero() {
+		rf.firstByteAt = time.Now()
+	}
+	rf.bytes += n
+	return n, err
+}
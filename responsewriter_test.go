@@ -0,0 +1,180 @@
+package httplib_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lab42/httplib"
+)
+
+// plainWriter is a response writer without any optional interface.
+type plainWriter struct {
+	http.ResponseWriter
+}
+
+// unwrapWriter is a response writer hiding the optional interfaces of the
+// writer it wraps, but exposing it through Unwrap.
+type unwrapWriter struct {
+	http.ResponseWriter
+}
+
+func (w unwrapWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func TestResponseWriterRecords(t *testing.T) {
+	rr := httptest.NewRecorder()
+	rw := httplib.NewResponseWriter(rr)
+
+	if rw.HeaderWritten() {
+		t.Error("Expected header not to be written yet")
+	}
+
+	time.Sleep(time.Millisecond)
+	rw.WriteHeader(http.StatusCreated)
+	rw.Write([]byte("Hello, "))
+	io.Copy(rw, strings.NewReader("World!"))
+
+	if rw.Status() != http.StatusCreated {
+		t.Errorf("Expected status %d, but got %d", http.StatusCreated, rw.Status())
+	}
+	if rw.BytesWritten() != 13 {
+		t.Errorf("Expected 13 bytes written, but got %d", rw.BytesWritten())
+	}
+	if !rw.HeaderWritten() || rw.HeaderWrittenAt().IsZero() {
+		t.Error("Expected header to be written")
+	}
+	if rw.TimeToFirstByte() < time.Millisecond {
+		t.Errorf("Expected time to first byte of at least 1ms, but got %v", rw.TimeToFirstByte())
+	}
+	if rr.Body.String() != "Hello, World!" {
+		t.Errorf("Expected response 'Hello, World!', but got '%s'", rr.Body.String())
+	}
+}
+
+func TestTeeResponseWriter(t *testing.T) {
+	var tee strings.Builder
+	rr := httptest.NewRecorder()
+	rw := httplib.NewTeeResponseWriter(rr, &tee)
+
+	rw.Write([]byte("Hello, "))
+	io.Copy(rw, strings.NewReader("World!"))
+
+	if tee.String() != "Hello, World!" {
+		t.Errorf("Expected tee 'Hello, World!', but got '%s'", tee.String())
+	}
+	if rr.Body.String() != "Hello, World!" {
+		t.Errorf("Expected response 'Hello, World!', but got '%s'", rr.Body.String())
+	}
+	if _, ok := rw.(http.Flusher); !ok {
+		t.Error("Expected writer to implement http.Flusher")
+	}
+}
+
+func TestResponseWriterOptionalInterfaces(t *testing.T) {
+	// httptest.ResponseRecorder only implements http.Flusher.
+	rw := httplib.NewResponseWriter(httptest.NewRecorder())
+	if _, ok := rw.(http.Flusher); !ok {
+		t.Error("Expected writer to implement http.Flusher")
+	}
+	if _, ok := rw.(http.Hijacker); ok {
+		t.Error("Expected writer not to implement http.Hijacker")
+	}
+	if _, ok := rw.(http.Pusher); ok {
+		t.Error("Expected writer not to implement http.Pusher")
+	}
+
+	rw = httplib.NewResponseWriter(plainWriter{httptest.NewRecorder()})
+	if _, ok := rw.(http.Flusher); ok {
+		t.Error("Expected writer not to implement http.Flusher")
+	}
+
+	// The response controller reaches the wrapped writer through Unwrap.
+	rr := httptest.NewRecorder()
+	rw = httplib.NewResponseWriter(unwrapWriter{rr})
+	if _, ok := rw.(http.Flusher); ok {
+		t.Error("Expected writer not to implement http.Flusher")
+	}
+	if err := http.NewResponseController(rw).Flush(); err != nil {
+		t.Errorf("Unexpected error flushing through Unwrap: %v", err)
+	}
+	if !rr.Flushed {
+		t.Error("Expected the recorder to be flushed")
+	}
+}
+
+// countingFlusher is an http.Flusher counting its flushes.
+type countingFlusher struct {
+	flushes int
+}
+
+func (f *countingFlusher) Flush() {
+	f.flushes++
+}
+
+func TestWithOptionalInterfaces(t *testing.T) {
+	rr := httptest.NewRecorder()
+	f := &countingFlusher{}
+
+	// The implementations given are exposed when the wrapped writer has their interface.
+	rw := httplib.WithOptionalInterfaces(httplib.NewResponseWriter(plainWriter{rr}), rr, httplib.OptionalInterfaces{Flusher: f})
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		t.Fatal("Expected writer to implement http.Flusher")
+	}
+	flusher.Flush()
+	if f.flushes != 1 {
+		t.Errorf("Expected 1 flush, but got %d", f.flushes)
+	}
+
+	// Interfaces without implementation are not exposed.
+	rw = httplib.WithOptionalInterfaces(httplib.NewResponseWriter(plainWriter{rr}), rr, httplib.OptionalInterfaces{})
+	if _, ok := rw.(http.Flusher); ok {
+		t.Error("Expected writer not to implement http.Flusher")
+	}
+}
+
+func TestResponseWriterServer(t *testing.T) {
+	var rw httplib.ResponseWriter
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw = httplib.NewResponseWriter(w)
+
+		// The server's writer supports flushing, hijacking and sendfile.
+		if _, ok := rw.(io.ReaderFrom); !ok {
+			t.Error("Expected writer to implement io.ReaderFrom")
+		}
+
+		conn, brw, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Unexpected error hijacking: %v", err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n"))
+
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || !strings.HasPrefix(status, "HTTP/1.1 101") {
+		t.Errorf("Expected switching protocols response, but got '%s' (%v)", status, err)
+	}
+	if rw.Status() != http.StatusSwitchingProtocols {
+		t.Errorf("Expected status %d, but got %d", http.StatusSwitchingProtocols, rw.Status())
+	}
+}
@@ -2,6 +2,9 @@ package httplib
 
 import "net/http"
 
+// Use wraps r with middlewares. Each middleware wraps the previous ones, so the
+// last middleware listed is the outermost one. Use Chain to apply middlewares
+// in declared order to any handler.
 func Use(r *http.ServeMux, middlewares ...func(next http.Handler) http.Handler) http.Handler {
 	var s http.Handler
 	s = r
@@ -1,11 +1,15 @@
 package httplib_test
 
 import (
+	"compress/gzip"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/lab42/httplib"
+	"github.com/lab42/httplib/middleware"
+	"go.uber.org/zap"
 )
 
 func TestUseMiddleware(t *testing.T) {
@@ -46,3 +50,46 @@ func TestUseMiddleware(t *testing.T) {
 		t.Errorf("Expected response '%s', but got '%s'", expectedResponse, rr.Body.String())
 	}
 }
+
+func TestUseMiddlewareStack(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/test", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello, World!"))
+	})
+
+	// Declare the whole stack in one Use call.
+	handler := httplib.Use(mux,
+		middleware.Timeout(time.Second),
+		middleware.Gzip(middleware.WithGzipLevel(gzip.BestSpeed)),
+		middleware.CSRF("abc123", middleware.WithCSRFHeader("X-Token")),
+		middleware.CSP("default-src 'self'"),
+		middleware.Zap(zap.NewNop(), middleware.WithZapSensitiveKeys("password")),
+		middleware.ZeroLog(middleware.WithZeroLogSensitiveKeys("password")),
+		middleware.Recovery(),
+	)
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.Header.Set("X-Token", "abc123")
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, but got %d", http.StatusOK, rr.Code)
+	}
+	if rr.Header().Get("Content-Security-Policy") != "default-src 'self'" {
+		t.Errorf("Expected CSP header to be set, but got '%s'", rr.Header().Get("Content-Security-Policy"))
+	}
+	if rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("Expected Content-Encoding to be 'gzip', but got '%s'", rr.Header().Get("Content-Encoding"))
+	}
+
+	// Requests without the CSRF token are rejected by the stack.
+	req = httptest.NewRequest("GET", "/test", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d, but got %d", http.StatusForbidden, rr.Code)
+	}
+}